@@ -0,0 +1,73 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package harvester
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// syncModeFull will fsync the plot file, rename it, and then fsync the
+	// parent directory so the rename itself is durable.
+	syncModeFull = "full"
+
+	// syncModeFile will only fsync the plot file before renaming it.
+	syncModeFile = "file"
+
+	// syncModeNone skips all syncing and leaves it to the kernel to flush the
+	// data in the background.
+	syncModeNone = "none"
+)
+
+// commitPlot will move the temporary file into its final location, flushing
+// it to disk based on the configured sync mode. The plotter deletes its copy
+// once it receives the response, so this must complete before acknowledging
+// the transfer. It returns the amount of time spent syncing.
+func commitPlot(f *os.File, tmpfile, dest string) (time.Duration, error) {
+	var synced time.Duration
+
+	// flush the file contents
+	if syncMode != syncModeNone {
+		start := time.Now()
+		if err := f.Sync(); err != nil {
+			return synced, err
+		}
+		synced += time.Since(start)
+	}
+
+	if err := f.Close(); err != nil {
+		return synced, err
+	}
+
+	// rename it so it can be used by the chia harvester
+	if err := os.Rename(tmpfile, dest); err != nil {
+		return synced, err
+	}
+
+	// flush the directory so the rename survives a power loss. if it can't
+	// be, move the plot back out of place so the plotter keeps its copy
+	if syncMode == syncModeFull {
+		start := time.Now()
+		if err := syncDir(filepath.Dir(dest)); err != nil {
+			if rerr := os.Rename(dest, tmpfile); rerr != nil {
+				os.Remove(dest)
+			}
+			return synced, err
+		}
+		synced += time.Since(start)
+	}
+
+	return synced, nil
+}
+
+// syncDir will fsync the specified directory.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
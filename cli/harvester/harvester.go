@@ -10,12 +10,13 @@ import (
 	"path/filepath"
 	"runtime"
 	"syscall"
+	"time"
 
 	"github.com/krobertson/chia-garden/cli"
 	"github.com/krobertson/chia-garden/pkg/rpc"
+	"github.com/krobertson/chia-garden/pkg/types"
 	"github.com/krobertson/chia-garden/pkg/utils"
 
-	"github.com/nats-io/nats.go"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
@@ -33,40 +34,146 @@ availability of a new plot file.`,
 		Run: cmdHarvester,
 	}
 
-	harvesterPaths []string
-	expandPaths    []string
-	maxTransfers   int64
-	httpServerIP   string
-	httpServerPort int
+	harvesterPaths    []string
+	expandPaths       []string
+	maxTransfers      int64
+	plotSuffix        string
+	httpServerIP      string
+	httpServerPort    int
+	progressInterval  time.Duration
+	stallTimeout      time.Duration
+	syncMode          string
+	ioMode            string
+	placementName     string
+	reserveSpace      string
+	reservePercent    int
+	maxPlots          int
+	pathLimitSpecs    []string
+	labelSpecs        []string
+	pathLabelSpecs    []string
+	affinitySpecs     []string
+	farmerKeys        []string
+	poolContracts     []string
+	heartbeatInterval time.Duration
 )
 
 func init() {
 	cli.RootCmd.AddCommand(HarvesterCmd)
 
 	viper.SetDefault("harvester.max_transfers", 5)
+	viper.SetDefault("harvester.suffix", "plot")
 	viper.SetDefault("harvester.http_ip", utils.GetHostIP().String())
 	viper.SetDefault("harvester.http_port", 3434)
+	viper.SetDefault("harvester.progress_interval", 30*time.Second)
+	viper.SetDefault("harvester.stall_timeout", 2*time.Minute)
+	viper.SetDefault("harvester.sync_mode", syncModeFull)
+	viper.SetDefault("harvester.io_mode", ioModeBuffered)
+	viper.SetDefault("harvester.placement", placementMostFree)
+	viper.SetDefault("harvester.reserve", "0")
+	viper.SetDefault("harvester.reserve_percent", 0)
+	viper.SetDefault("harvester.max_plots", 0)
+	viper.SetDefault("harvester.path_limits", []string{})
+	viper.SetDefault("harvester.labels", []string{})
+	viper.SetDefault("harvester.path_labels", []string{})
+	viper.SetDefault("harvester.affinity", []string{})
+	viper.SetDefault("harvester.farmer_keys", []string{})
+	viper.SetDefault("harvester.pool_contracts", []string{})
+	viper.SetDefault("harvester.heartbeat_interval", rpc.DefaultHeartbeatInterval)
 
 	viper.BindEnv("harvester.max_transfers")
+	viper.BindEnv("harvester.suffix")
 	viper.BindEnv("harvester.http_ip")
 	viper.BindEnv("harvester.http_port")
+	viper.BindEnv("harvester.progress_interval")
+	viper.BindEnv("harvester.stall_timeout")
+	viper.BindEnv("harvester.sync_mode")
+	viper.BindEnv("harvester.io_mode")
+	viper.BindEnv("harvester.placement")
+	viper.BindEnv("harvester.reserve")
+	viper.BindEnv("harvester.reserve_percent")
+	viper.BindEnv("harvester.max_plots")
+	viper.BindEnv("harvester.path_limits")
+	viper.BindEnv("harvester.labels")
+	viper.BindEnv("harvester.path_labels")
+	viper.BindEnv("harvester.affinity")
+	viper.BindEnv("harvester.farmer_keys")
+	viper.BindEnv("harvester.pool_contracts")
+	viper.BindEnv("harvester.heartbeat_interval")
 
 	HarvesterCmd.Flags().StringSliceVarP(&harvesterPaths, "path", "p", nil, "Path to store plots")
 	HarvesterCmd.Flags().StringSliceVarP(&expandPaths, "expand-path", "x", nil, "Path containing multiple directories to store plots")
 	HarvesterCmd.Flags().Int64VarP(&maxTransfers, "max-transfers", "t", viper.GetInt64("harvester.max_transfers"), "Max concurrent transfers")
+	HarvesterCmd.Flags().StringVarP(&plotSuffix, "suffix", "s", viper.GetString("harvester.suffix"), "The suffix or extension of plot files")
 	HarvesterCmd.Flags().StringVarP(&httpServerIP, "http-ip", "", viper.GetString("harvester.http_ip"), "IP to use to identify itself (mainly need if in Docker)")
 	HarvesterCmd.Flags().IntVarP(&httpServerPort, "http-port", "", viper.GetInt("harvester.http_port"), "Port to handle transfers")
+	HarvesterCmd.Flags().DurationVarP(&progressInterval, "progress-interval", "", viper.GetDuration("harvester.progress_interval"), "How often to log and publish transfer progress")
+	HarvesterCmd.Flags().DurationVarP(&stallTimeout, "stall-timeout", "", viper.GetDuration("harvester.stall_timeout"), "Abort transfers which receive no data for this long")
+	HarvesterCmd.Flags().StringVarP(&syncMode, "sync-mode", "", viper.GetString("harvester.sync_mode"), "How to flush plots to disk before acknowledging (full, file, none)")
+	HarvesterCmd.Flags().StringVarP(&ioMode, "io-mode", "", viper.GetString("harvester.io_mode"), "How plots are written to disk (buffered, dropbehind, direct)")
+	HarvesterCmd.Flags().StringVarP(&placementName, "placement", "", viper.GetString("harvester.placement"), "How to choose the disk for each plot (most-free, fill-first, round-robin, weighted-random, percent-full)")
+	HarvesterCmd.Flags().StringVarP(&reserveSpace, "reserve", "", viper.GetString("harvester.reserve"), "Space to leave free on each disk, such as 50GiB")
+	HarvesterCmd.Flags().IntVarP(&reservePercent, "reserve-percent", "", viper.GetInt("harvester.reserve_percent"), "Percent of each disk to leave free")
+	HarvesterCmd.Flags().IntVarP(&maxPlots, "max-plots", "", viper.GetInt("harvester.max_plots"), "Max plots to store on each disk")
+	HarvesterCmd.Flags().StringArrayVarP(&pathLimitSpecs, "path-limit", "", viper.GetStringSlice("harvester.path_limits"), "Override the limits for a path, as path:reserve=50GiB,reserve-percent=1,max-plots=100")
+	HarvesterCmd.Flags().StringArrayVarP(&labelSpecs, "label", "", viper.GetStringSlice("harvester.labels"), "Labels for all paths on this harvester, as key=value,key=value")
+	HarvesterCmd.Flags().StringArrayVarP(&pathLabelSpecs, "path-label", "", viper.GetStringSlice("harvester.path_labels"), "Labels for a path, as path:key=value,key=value")
+	HarvesterCmd.Flags().StringArrayVarP(&affinitySpecs, "affinity", "", viper.GetStringSlice("harvester.affinity"), "Only store plots with matching attributes on paths with the labels, as attr=value:key=value")
+	HarvesterCmd.Flags().StringSliceVarP(&farmerKeys, "farmer-key", "", viper.GetStringSlice("harvester.farmer_keys"), "Only accept plots for these farmer public keys")
+	HarvesterCmd.Flags().StringSliceVarP(&poolContracts, "pool-contract", "", viper.GetStringSlice("harvester.pool_contracts"), "Only accept plots for these pool contract addresses")
+	HarvesterCmd.Flags().DurationVarP(&heartbeatInterval, "heartbeat-interval", "", viper.GetDuration("harvester.heartbeat_interval"), "How often to announce the harvester's state to plotters")
 
 	viper.BindPFlag("harvester.max_transfers", HarvesterCmd.Flags().Lookup("max-transfers"))
+	viper.BindPFlag("harvester.suffix", HarvesterCmd.Flags().Lookup("suffix"))
 	viper.BindPFlag("harvester.http_ip", HarvesterCmd.Flags().Lookup("http-ip"))
 	viper.BindPFlag("harvester.http_port", HarvesterCmd.Flags().Lookup("http-port"))
+	viper.BindPFlag("harvester.progress_interval", HarvesterCmd.Flags().Lookup("progress-interval"))
+	viper.BindPFlag("harvester.stall_timeout", HarvesterCmd.Flags().Lookup("stall-timeout"))
+	viper.BindPFlag("harvester.sync_mode", HarvesterCmd.Flags().Lookup("sync-mode"))
+	viper.BindPFlag("harvester.io_mode", HarvesterCmd.Flags().Lookup("io-mode"))
+	viper.BindPFlag("harvester.placement", HarvesterCmd.Flags().Lookup("placement"))
+	viper.BindPFlag("harvester.reserve", HarvesterCmd.Flags().Lookup("reserve"))
+	viper.BindPFlag("harvester.reserve_percent", HarvesterCmd.Flags().Lookup("reserve-percent"))
+	viper.BindPFlag("harvester.max_plots", HarvesterCmd.Flags().Lookup("max-plots"))
+	viper.BindPFlag("harvester.path_limits", HarvesterCmd.Flags().Lookup("path-limit"))
+	viper.BindPFlag("harvester.labels", HarvesterCmd.Flags().Lookup("label"))
+	viper.BindPFlag("harvester.path_labels", HarvesterCmd.Flags().Lookup("path-label"))
+	viper.BindPFlag("harvester.affinity", HarvesterCmd.Flags().Lookup("affinity"))
+	viper.BindPFlag("harvester.farmer_keys", HarvesterCmd.Flags().Lookup("farmer-key"))
+	viper.BindPFlag("harvester.pool_contracts", HarvesterCmd.Flags().Lookup("pool-contract"))
+	viper.BindPFlag("harvester.heartbeat_interval", HarvesterCmd.Flags().Lookup("heartbeat-interval"))
 }
 
 func cmdHarvester(cmd *cobra.Command, args []string) {
 	log.Printf("GOMAXPROCS set to %d", runtime.GOMAXPROCS(0))
 	log.Print("Starting harvester-client...")
 
-	conn, err := nats.Connect(cli.NatsUrl, nats.MaxReconnects(-1))
+	// validate the settings before accepting any transfers
+	switch syncMode {
+	case syncModeFull, syncModeFile, syncModeNone:
+	default:
+		log.Fatalf("Invalid sync mode %q, must be one of full, file, or none", syncMode)
+	}
+	switch ioMode {
+	case ioModeBuffered, ioModeDropBehind, ioModeDirect:
+	default:
+		log.Fatalf("Invalid io mode %q, must be one of buffered, dropbehind, or direct", ioMode)
+	}
+	if stallTimeout <= 0 {
+		log.Fatalf("Invalid stall timeout %s, must be greater than 0", stallTimeout.String())
+	}
+	if heartbeatInterval <= 0 {
+		log.Fatalf("Invalid heartbeat interval %s, must be greater than 0", heartbeatInterval.String())
+	}
+
+	// the raw setting is parsed, as a percent sign or out of range value from
+	// the environment would otherwise quietly become 0
+	percent, err := parseReservePercent(viper.GetString("harvester.reserve_percent"))
+	if err != nil {
+		log.Fatalf("Invalid reserve percent setting: %v", err)
+	}
+	reservePercent = percent
+
+	conn, err := cli.Connect("chia-garden harvester")
 	if err != nil {
 		log.Fatal("Failed to connect to NATS: ", err)
 	}
@@ -99,12 +206,30 @@ func cmdHarvester(cmd *cobra.Command, args []string) {
 		log.Fatal("Failed to initialize harvester: ", err)
 	}
 
-	// initialize the rpc
-	_, err = rpc.NewNatsHarvesterListener(conn, server)
+	// initialize the rpc, with pending requests cancelled on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err = rpc.NewNatsHarvesterListener(ctx, conn, systemHostname, server)
 	if err != nil {
 		log.Fatal("Failed to initialize NATS listener: ", err)
 	}
 
+	// periodically report on active transfers
+	go server.tracker.Run(progressInterval, func(p *types.TransferProgress) {
+		rpc.PublishTransferProgress(conn, p)
+	})
+
+	// let plotters know the harvester is online
+	if err := server.runHeartbeats(conn); err != nil {
+		log.Fatal("Failed to start heartbeats: ", err)
+	}
+
+	// allow transfers to be cancelled on demand
+	_, err = rpc.SubscribeTransferCancel(conn, server.TransferCancel)
+	if err != nil {
+		log.Fatal("Failed to subscribe to cancel requests: ", err)
+	}
+
 	// add TERM signal handling to call to http shutdown
 	shutdown := make(chan struct{})
 	go func() {
@@ -112,8 +237,12 @@ func cmdHarvester(cmd *cobra.Command, args []string) {
 		signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
 		<-sigint
 
-		// close nats connection
-		conn.Close()
+		// decline new plots while the active transfers finish, so plotters
+		// know to send them elsewhere rather than waiting on this host
+		log.Print("Shutting down, waiting for active transfers to finish...")
+		server.draining.Store(true)
+		rpc.PublishHeartbeat(conn, server.heartbeat())
+		cancel()
 
 		// http shutdown and wait for requests to finish
 		err := server.httpServer.Shutdown(context.Background())
@@ -121,6 +250,9 @@ func cmdHarvester(cmd *cobra.Command, args []string) {
 			log.Printf("HTTP server Shutdown: %v", err)
 		}
 
+		// close nats connection
+		conn.Close()
+
 		// close channel to exit
 		close(shutdown)
 	}()
@@ -0,0 +1,56 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package harvester
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/krobertson/chia-garden/pkg/rpc"
+	"github.com/krobertson/chia-garden/pkg/types"
+
+	"github.com/nats-io/nats.go"
+)
+
+// heartbeat returns a summary of the harvester's current state, which is
+// published periodically so plotters know it is online.
+func (h *harvester) heartbeat() *types.Heartbeat {
+	hb := &types.Heartbeat{
+		Hostname:     systemHostname,
+		Url:          fmt.Sprintf("http://%s", h.hostPort),
+		Interval:     heartbeatInterval,
+		Transfers:    h.transfers.Load(),
+		MaxTransfers: maxTransfers,
+		Draining:     h.draining.Load(),
+	}
+
+	h.sortMutex.Lock()
+	defer h.sortMutex.Unlock()
+	for _, p := range h.sortedPlots {
+		hb.Paths++
+		if p.busy.Load() || p.paused.Load() {
+			hb.BusyPaths++
+		}
+		hb.Plots += p.plots
+		hb.FreeSpace += p.freeSpace
+		hb.TotalSpace += p.totalSpace
+	}
+	return hb
+}
+
+// runHeartbeats publishes a heartbeat at the interval, and answers requests for
+// the harvester's state in between.
+func (h *harvester) runHeartbeats(conn *nats.Conn) error {
+	_, err := rpc.SubscribeHeartbeatRequests(conn, h.heartbeat)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		rpc.PublishHeartbeat(conn, h.heartbeat())
+		for range time.Tick(heartbeatInterval) {
+			rpc.PublishHeartbeat(conn, h.heartbeat())
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package harvester
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"github.com/krobertson/chia-garden/pkg/utils"
+)
+
+const (
+	// ioModeBuffered writes through the page cache as normal.
+	ioModeBuffered = "buffered"
+
+	// ioModeDropBehind writes through the page cache, but progressively
+	// flushes and drops the written pages.
+	ioModeDropBehind = "dropbehind"
+
+	// ioModeDirect writes with O_DIRECT, bypassing the page cache.
+	ioModeDirect = "direct"
+)
+
+// plotWriter is the writer used to receive a plot. Flush must be called once
+// all data has been written.
+type plotWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// bufferedWriter is a plotWriter which writes straight to the file.
+type bufferedWriter struct {
+	*os.File
+}
+
+func (w bufferedWriter) Flush() error {
+	return nil
+}
+
+// createPlotFile will create the temporary file for receiving a plot and
+// return the writer to use based on the configured IO mode. If O_DIRECT isn't
+// supported by the filesystem, it will fall back to drop-behind.
+func createPlotFile(name string) (*os.File, plotWriter, error) {
+	if ioMode == ioModeDirect {
+		f, err := utils.OpenDirect(name)
+		if err == nil {
+			return f, utils.NewDirectWriter(f), nil
+		}
+		log.Printf("Failed to open %s with O_DIRECT, falling back to %s: %v", name, ioModeDropBehind, err)
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if ioMode == ioModeBuffered {
+		return f, bufferedWriter{f}, nil
+	}
+	return f, utils.NewDropBehindWriter(f), nil
+}
+
+// rangeWriter returns the writer to use for a range of a multi-stream upload
+// starting at offset, based on the configured IO mode. The ranges are written
+// concurrently at unaligned offsets, which O_DIRECT can't handle, so direct
+// mode uses drop-behind for them instead.
+func rangeWriter(f *os.File, offset int64) plotWriter {
+	if ioMode == ioModeBuffered {
+		return offsetWriter{io.NewOffsetWriter(f, offset)}
+	}
+	return utils.NewDropBehindWriterAt(f, offset)
+}
+
+// offsetWriter is a plotWriter which writes straight to the file at an offset.
+type offsetWriter struct {
+	*io.OffsetWriter
+}
+
+func (w offsetWriter) Flush() error {
+	return nil
+}
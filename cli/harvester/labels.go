@@ -0,0 +1,112 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package harvester
+
+import (
+	"fmt"
+	"maps"
+	"path/filepath"
+	"strings"
+)
+
+// affinityRule restricts which plot paths a plot can be stored on. When all of
+// the plot attributes in match are the same on a plot, it can only be stored
+// on paths which have all of the labels in require.
+type affinityRule struct {
+	match   map[string]string
+	require map[string]string
+}
+
+// parseLabels parses a comma separated list of key=value pairs.
+func parseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid label %q, must be in the form key=value", kv)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// parsePathLabels parses the labels for individual plot paths, each in the
+// form "path:key=value,key=value". As with the path limits, labels for a
+// directory given as an expand path apply to each of the directories within
+// it.
+func parsePathLabels(specs []string) (map[string]map[string]string, error) {
+	pathLabels := make(map[string]map[string]string, len(specs))
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid path label %q, must be in the form path:key=value", spec)
+		}
+		path, err := filepath.Abs(spec[:i])
+		if err != nil {
+			return nil, err
+		}
+		labels, err := parseLabels(spec[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		pathLabels[path] = labels
+	}
+	return pathLabels, nil
+}
+
+// lookupLabels returns the labels for the plot path, which are the harvester's
+// labels combined with those for the path or its parent directory.
+func lookupLabels(pathLabels map[string]map[string]string, path string, labels map[string]string) map[string]string {
+	merged := maps.Clone(labels)
+	if l, ok := pathLabels[filepath.Dir(path)]; ok {
+		maps.Copy(merged, l)
+	}
+	if l, ok := pathLabels[path]; ok {
+		maps.Copy(merged, l)
+	}
+	return merged
+}
+
+// parseAffinity parses the affinity rules, each in the form
+// "attr=value,attr=value:label=value,label=value".
+func parseAffinity(specs []string) ([]*affinityRule, error) {
+	rules := make([]*affinityRule, 0, len(specs))
+	for _, spec := range specs {
+		match, require, ok := strings.Cut(spec, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid affinity %q, must be in the form attr=value:label=value", spec)
+		}
+		rule := &affinityRule{}
+		var err error
+		if rule.match, err = parseLabels(match); err != nil {
+			return nil, fmt.Errorf("invalid affinity %q: %w", spec, err)
+		}
+		if rule.require, err = parseLabels(require); err != nil {
+			return nil, fmt.Errorf("invalid affinity %q: %w", spec, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// hasAll returns whether all of the pairs in want are in have.
+func hasAll(have, want map[string]string) bool {
+	for k, v := range want {
+		if have[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// allows returns whether a plot with the attributes can be stored on the plot
+// path, based on the affinity rules. Plots which no rule matches can be stored
+// on any path.
+func (p *plotPath) allows(rules []*affinityRule, attrs map[string]string) bool {
+	for _, rule := range rules {
+		if hasAll(attrs, rule.match) && !hasAll(p.labels, rule.require) {
+			return false
+		}
+	}
+	return true
+}
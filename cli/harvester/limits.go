@@ -0,0 +1,112 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package harvester
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// pathLimits are the thresholds which stop a plot path from being filled any
+// further, leaving room for filesystem metadata and performance.
+type pathLimits struct {
+	reserveBytes   uint64
+	reservePercent int
+	maxPlots       int
+}
+
+// defaultLimits returns the limits configured for all plot paths.
+func defaultLimits() (pathLimits, error) {
+	reserve, err := humanize.ParseBytes(reserveSpace)
+	if err != nil {
+		return pathLimits{}, fmt.Errorf("invalid reserve %q: %w", reserveSpace, err)
+	}
+	return pathLimits{
+		reserveBytes:   reserve,
+		reservePercent: reservePercent,
+		maxPlots:       maxPlots,
+	}, nil
+}
+
+// parsePathLimits parses the per-path overrides of the default limits. Each is
+// in the form "path:key=value,key=value", where the keys are reserve,
+// reserve-percent and max-plots. Limits for a directory given as an expand path
+// apply to each of the directories within it.
+func parsePathLimits(specs []string, defaults pathLimits) (map[string]pathLimits, error) {
+	limits := make(map[string]pathLimits, len(specs))
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid path limit %q, must be in the form path:key=value", spec)
+		}
+		path, err := filepath.Abs(spec[:i])
+		if err != nil {
+			return nil, err
+		}
+
+		l := defaults
+		for _, kv := range strings.Split(spec[i+1:], ",") {
+			key, value, _ := strings.Cut(kv, "=")
+			switch key {
+			case "reserve":
+				l.reserveBytes, err = humanize.ParseBytes(value)
+			case "reserve-percent":
+				l.reservePercent, err = parseReservePercent(value)
+			case "max-plots":
+				l.maxPlots, err = strconv.Atoi(value)
+			default:
+				err = fmt.Errorf("unknown key %q", key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid path limit %q: %w", spec, err)
+			}
+		}
+		limits[path] = l
+	}
+	return limits, nil
+}
+
+// parseReservePercent parses a percent of the disk to leave free, with or
+// without a trailing percent sign. It must be from 0 to 100.
+func parseReservePercent(value string) (int, error) {
+	percent, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid reserve percent %q", value)
+	}
+	if percent < 0 || percent > 100 {
+		return 0, fmt.Errorf("invalid reserve percent %q, must be from 0 to 100", value)
+	}
+	return percent, nil
+}
+
+// lookupLimits returns the limits for the plot path, falling back to the ones
+// for its parent directory and then the defaults.
+func lookupLimits(limits map[string]pathLimits, path string, defaults pathLimits) pathLimits {
+	if l, ok := limits[path]; ok {
+		return l
+	}
+	if l, ok := limits[filepath.Dir(path)]; ok {
+		return l
+	}
+	return defaults
+}
+
+// reserved returns how much space is held back on the plot path's disk.
+func (p *plotPath) reserved() uint64 {
+	return max(p.limits.reserveBytes, p.totalSpace/100*uint64(p.limits.reservePercent))
+}
+
+// full returns whether the plot path has reached its maximum number of plots.
+func (p *plotPath) full() bool {
+	return p.limits.maxPlots > 0 && p.plots >= p.limits.maxPlots
+}
+
+// hasRoom returns whether a plot of the given size can be stored on the plot
+// path without going into the reserved space or over the maximum plots.
+func (p *plotPath) hasRoom(size uint64) bool {
+	return !p.full() && p.freeSpace > size+p.reserved()
+}
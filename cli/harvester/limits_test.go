@@ -0,0 +1,44 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package harvester
+
+import (
+	"testing"
+)
+
+func TestParseReservePercent(t *testing.T) {
+	for value, expected := range map[string]int{"0": 0, "5": 5, "5%": 5, "100": 100, "100%": 100} {
+		percent, err := parseReservePercent(value)
+		if err != nil {
+			t.Errorf("parseReservePercent(%q) returned error: %v", value, err)
+		} else if percent != expected {
+			t.Errorf("parseReservePercent(%q) returned %d, expected %d", value, percent, expected)
+		}
+	}
+
+	for _, value := range []string{"", "-1", "-5%", "101", "150%", "1.5", "5%%", "five"} {
+		if _, err := parseReservePercent(value); err == nil {
+			t.Errorf("parseReservePercent(%q) should return an error", value)
+		}
+	}
+}
+
+func TestParsePathLimits(t *testing.T) {
+	defaults := pathLimits{reserveBytes: 1000, reservePercent: 1, maxPlots: 10}
+	limits, err := parsePathLimits([]string{"/a:reserve-percent=5%,max-plots=20", "/b:reserve=1KB"}, defaults)
+	if err != nil {
+		t.Fatalf("parsePathLimits returned error: %v", err)
+	}
+	if l := limits["/a"]; l != (pathLimits{reserveBytes: 1000, reservePercent: 5, maxPlots: 20}) {
+		t.Errorf("limits for /a are %+v", l)
+	}
+	if l := limits["/b"]; l != (pathLimits{reserveBytes: 1000, reservePercent: 1, maxPlots: 10}) {
+		t.Errorf("limits for /b are %+v", l)
+	}
+
+	for _, spec := range []string{"/a", "/a:reserve-percent=150%", "/a:reserve-percent=-1", "/a:bogus=1"} {
+		if _, err := parsePathLimits([]string{spec}, defaults); err == nil {
+			t.Errorf("parsePathLimits(%q) should return an error", spec)
+		}
+	}
+}
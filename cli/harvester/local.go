@@ -0,0 +1,149 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package harvester
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/krobertson/chia-garden/pkg/transfer"
+	"github.com/krobertson/chia-garden/pkg/types"
+	"github.com/krobertson/chia-garden/pkg/utils"
+
+	"github.com/dustin/go-humanize"
+)
+
+// PlotMove is sent by a plotter running on the same machine as the harvester,
+// so the plot can be moved directly rather than sent over HTTP. The store is
+// reserved the same as a transfer, so it still respects the busy locking and
+// free space checks. The plot is renamed into place if it is on the same
+// filesystem, and otherwise copied.
+func (h *harvester) PlotMove(ctx context.Context, req *types.PlotMoveRequest) (*types.PlotMoveResponse, error) {
+	path := filepath.Join(req.Store, req.Name)
+
+	// only move plots for a plotter on the same machine. the request is sent to
+	// the harvester by hostname, which isn't always unique
+	if req.MachineId == "" || req.MachineId != systemMachineId {
+		return nil, fmt.Errorf("request to move %s is not from a plotter on this machine", req.Source)
+	}
+
+	// ensure the source is a plot the plotter could have created, and not
+	// some other file this harvester can access
+	if !filepath.IsAbs(req.Source) || filepath.Ext(req.Source) != "."+plotSuffix ||
+		filepath.Base(req.Source) != req.Name {
+		return nil, fmt.Errorf("request to move %s is not for a plot", req.Source)
+	}
+	fi, err := os.Lstat(req.Source)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("plot %s is not a regular file", req.Source)
+	}
+	if fi.Size() != int64(req.Size) {
+		return nil, fmt.Errorf("plot %s is %d bytes, expected %d", req.Source, fi.Size(), req.Size)
+	}
+
+	// validate the request and lock the plot path
+	plotPath, derr := h.reserveStore(path, int64(req.Size))
+	if derr != nil {
+		return &types.PlotMoveResponse{Status: derr.Status}, nil
+	}
+	defer h.releaseStore(plotPath)
+
+	return &types.PlotMoveResponse{
+		Status: h.movePlot(plotPath, req.Source, path, int64(req.Size)),
+	}, nil
+}
+
+// movePlot will move the plot from the source into the reserved plot path. It
+// returns the status code to report back to the plotter.
+func (h *harvester) movePlot(plotPath *plotPath, source, path string, size int64) int {
+	start := time.Now()
+	err := os.Rename(source, path)
+	if err == nil {
+		if syncMode == syncModeFull {
+			syncDir(filepath.Dir(path))
+			syncDir(filepath.Dir(source))
+		}
+
+		log.Printf("Successfully moved %s to %s (%f secs)", source, path, time.Since(start).Seconds())
+		plotPath.updateFreeSpace()
+		h.sortPaths()
+		return 201
+	}
+
+	if !errors.Is(err, syscall.EXDEV) {
+		log.Printf("Failed to move plot %s to %s: %v", source, path, err)
+		return 500
+	}
+
+	// on a different filesystem, so copy it with copy_file_range so the data
+	// doesn't go through userspace
+	progress := h.tracker.Start(filepath.Base(path), "local", size)
+	defer h.tracker.Finish(progress)
+	return h.copyPlot(plotPath, source, path, size, progress)
+}
+
+// copyPlot copies the plot from the source into a temporary file in the
+// reserved plot path and then commits it. It returns the status code to
+// report back to the plotter.
+func (h *harvester) copyPlot(plotPath *plotPath, source, path string, size int64, progress *transfer.Progress) int {
+	src, err := os.Open(source)
+	if err != nil {
+		log.Printf("Failed to open plot %s: %v", source, err)
+		return 500
+	}
+	defer src.Close()
+
+	tmpfile := path + ".tmp"
+	os.Remove(tmpfile)
+	dst, err := os.Create(tmpfile)
+	if err != nil {
+		log.Printf("Failed to open file at %s: %v", tmpfile, err)
+		plotPath.pause()
+		return 500
+	}
+	defer dst.Close()
+
+	log.Printf("Copying plot %s to %s", source, path)
+	start := time.Now()
+	err = utils.CopyFile(progress.Context(), dst, src, size, progress.Add)
+	if cerr := progress.Cancelled(); cerr != nil {
+		log.Printf("Copy of plot %s was cancelled, aborting", source)
+		dst.Close()
+		os.Remove(tmpfile)
+		return 410
+	}
+	if err != nil {
+		log.Printf("Failure while copying plot %s: %v", source, err)
+		dst.Close()
+		os.Remove(tmpfile)
+		plotPath.pause()
+		return 500
+	}
+
+	// flush and rename it so it can be used by the chia harvester
+	synced, err := commitPlot(dst, tmpfile, path)
+	if err != nil {
+		log.Printf("Failed to commit final plot %s: %v", path, err)
+		dst.Close()
+		os.Remove(tmpfile)
+		plotPath.pause()
+		return 500
+	}
+
+	seconds := time.Since(start).Seconds()
+	log.Printf("Successfully copied %s to %s (%s, %f secs, %s/sec, %s sync)",
+		source, path, humanize.IBytes(uint64(size)), seconds, humanize.Bytes(uint64(float64(size)/seconds)), synced.String())
+
+	plotPath.updateFreeSpace()
+	h.sortPaths()
+	return 201
+}
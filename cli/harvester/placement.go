@@ -0,0 +1,141 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package harvester
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+const (
+	// placementMostFree stores plots on the path with the most free space, so
+	// disks fill at an even rate.
+	placementMostFree = "most-free"
+
+	// placementFillFirst stores plots on the first path in the order they
+	// were given until it is full, and then moves onto the next.
+	placementFillFirst = "fill-first"
+
+	// placementRoundRobin rotates through the paths in the order they were
+	// given.
+	placementRoundRobin = "round-robin"
+
+	// placementWeightedRandom picks a random path, weighted by how much free
+	// space each has.
+	placementWeightedRandom = "weighted-random"
+
+	// placementPercentFull stores plots on the path which is the least full
+	// as a percentage, so mixed size disks fill up at the same time.
+	placementPercentFull = "percent-full"
+)
+
+// placement is a strategy for choosing which plot path a new plot is stored on.
+type placement interface {
+	// pick returns the path to use from the candidates, which are all
+	// available and have room for the plot. There is always at least one
+	// candidate. It is called with the harvester's sort mutex held.
+	pick(candidates []*plotPath) *plotPath
+}
+
+// newPlacement returns the placement strategy with the given name.
+func newPlacement(name string) (placement, error) {
+	switch name {
+	case placementMostFree:
+		return mostFree{}, nil
+	case placementFillFirst:
+		return fillFirst{}, nil
+	case placementRoundRobin:
+		return &roundRobin{}, nil
+	case placementWeightedRandom:
+		return weightedRandom{}, nil
+	case placementPercentFull:
+		return percentFull{}, nil
+	}
+	return nil, fmt.Errorf("invalid placement %q, must be one of %s, %s, %s, %s, or %s", name,
+		placementMostFree, placementFillFirst, placementRoundRobin, placementWeightedRandom, placementPercentFull)
+}
+
+// mostFree picks the path with the most free space.
+type mostFree struct{}
+
+func (mostFree) pick(candidates []*plotPath) *plotPath {
+	best := candidates[0]
+	for _, p := range candidates[1:] {
+		if p.freeSpace > best.freeSpace {
+			best = p
+		}
+	}
+	return best
+}
+
+// fillFirst picks the first path in the order they were given.
+type fillFirst struct{}
+
+func (fillFirst) pick(candidates []*plotPath) *plotPath {
+	best := candidates[0]
+	for _, p := range candidates[1:] {
+		if p.index < best.index {
+			best = p
+		}
+	}
+	return best
+}
+
+// roundRobin picks the next path after the last one it picked, in the order
+// they were given, wrapping back around to the start.
+type roundRobin struct {
+	next int
+}
+
+func (r *roundRobin) pick(candidates []*plotPath) *plotPath {
+	var best, first *plotPath
+	for _, p := range candidates {
+		if first == nil || p.index < first.index {
+			first = p
+		}
+		if p.index >= r.next && (best == nil || p.index < best.index) {
+			best = p
+		}
+	}
+	if best == nil {
+		best = first
+	}
+	r.next = best.index + 1
+	return best
+}
+
+// weightedRandom picks a random path, with the odds of each being picked based
+// on its share of the total free space.
+type weightedRandom struct{}
+
+func (weightedRandom) pick(candidates []*plotPath) *plotPath {
+	var total uint64
+	for _, p := range candidates {
+		total += p.freeSpace
+	}
+	if total == 0 {
+		return candidates[rand.Intn(len(candidates))]
+	}
+
+	n := uint64(rand.Int63n(int64(total)))
+	for _, p := range candidates {
+		if n < p.freeSpace {
+			return p
+		}
+		n -= p.freeSpace
+	}
+	return candidates[len(candidates)-1]
+}
+
+// percentFull picks the path with the highest percentage of free space.
+type percentFull struct{}
+
+func (percentFull) pick(candidates []*plotPath) *plotPath {
+	best := candidates[0]
+	for _, p := range candidates[1:] {
+		if p.freeRatio() > best.freeRatio() {
+			best = p
+		}
+	}
+	return best
+}
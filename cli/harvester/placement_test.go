@@ -0,0 +1,148 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package harvester
+
+import (
+	"testing"
+)
+
+// testPaths returns fake plot paths with the given free and total space, in
+// the order they were given.
+func testPaths(space ...[2]uint64) []*plotPath {
+	paths := make([]*plotPath, len(space))
+	for i, s := range space {
+		paths[i] = &plotPath{
+			path:       string(rune('a' + i)),
+			index:      i,
+			freeSpace:  s[0],
+			totalSpace: s[1],
+		}
+	}
+	return paths
+}
+
+func TestNewPlacement(t *testing.T) {
+	for _, name := range []string{placementMostFree, placementFillFirst, placementRoundRobin, placementWeightedRandom, placementPercentFull} {
+		if _, err := newPlacement(name); err != nil {
+			t.Errorf("newPlacement(%q) returned error: %v", name, err)
+		}
+	}
+	if _, err := newPlacement("bogus"); err == nil {
+		t.Error("newPlacement(\"bogus\") should return an error")
+	}
+}
+
+func TestMostFree(t *testing.T) {
+	paths := testPaths([2]uint64{10, 100}, [2]uint64{30, 100}, [2]uint64{20, 100})
+	if p := (mostFree{}).pick(paths); p != paths[1] {
+		t.Errorf("picked %s, expected %s", p.path, paths[1].path)
+	}
+
+	// ties go to the first candidate
+	paths = testPaths([2]uint64{30, 100}, [2]uint64{30, 100})
+	if p := (mostFree{}).pick(paths); p != paths[0] {
+		t.Errorf("picked %s, expected %s", p.path, paths[0].path)
+	}
+}
+
+func TestFillFirst(t *testing.T) {
+	paths := testPaths([2]uint64{10, 100}, [2]uint64{30, 100}, [2]uint64{20, 100})
+
+	// candidates are sorted by free space, but the order given is used
+	candidates := []*plotPath{paths[1], paths[2], paths[0]}
+	if p := (fillFirst{}).pick(candidates); p != paths[0] {
+		t.Errorf("picked %s, expected %s", p.path, paths[0].path)
+	}
+
+	// once the first is full, the next is used
+	candidates = []*plotPath{paths[1], paths[2]}
+	if p := (fillFirst{}).pick(candidates); p != paths[1] {
+		t.Errorf("picked %s, expected %s", p.path, paths[1].path)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	paths := testPaths([2]uint64{10, 100}, [2]uint64{30, 100}, [2]uint64{20, 100})
+	r := &roundRobin{}
+
+	// rotates in the order given, regardless of the candidate order
+	candidates := []*plotPath{paths[1], paths[2], paths[0]}
+	for i, expected := range []int{0, 1, 2, 0, 1} {
+		if p := r.pick(candidates); p != paths[expected] {
+			t.Errorf("pick %d picked %s, expected %s", i, p.path, paths[expected].path)
+		}
+	}
+}
+
+func TestRoundRobinSkipsUnavailable(t *testing.T) {
+	paths := testPaths([2]uint64{10, 100}, [2]uint64{30, 100}, [2]uint64{20, 100})
+
+	// the next path isn't a candidate, so the one after it is used
+	r := &roundRobin{next: 1}
+	candidates := []*plotPath{paths[0], paths[2]}
+	if p := r.pick(candidates); p != paths[2] {
+		t.Errorf("picked %s, expected %s", p.path, paths[2].path)
+	}
+
+	// nothing after the last path picked is a candidate, so it wraps around
+	candidates = []*plotPath{paths[1], paths[0]}
+	if p := r.pick(candidates); p != paths[0] {
+		t.Errorf("picked %s, expected %s", p.path, paths[0].path)
+	}
+	if r.next != 1 {
+		t.Errorf("next is %d, expected 1", r.next)
+	}
+}
+
+func TestWeightedRandom(t *testing.T) {
+	paths := testPaths([2]uint64{0, 100}, [2]uint64{50, 100}, [2]uint64{0, 100})
+
+	// only the path with free space can be picked
+	for i := 0; i < 100; i++ {
+		if p := (weightedRandom{}).pick(paths); p != paths[1] {
+			t.Fatalf("picked %s, expected %s", p.path, paths[1].path)
+		}
+	}
+
+	// both paths are picked in roughly their share of the free space
+	paths = testPaths([2]uint64{75, 100}, [2]uint64{25, 100})
+	counts := make(map[*plotPath]int)
+	for i := 0; i < 1000; i++ {
+		counts[(weightedRandom{}).pick(paths)]++
+	}
+	if counts[paths[0]] < 600 || counts[paths[1]] < 150 {
+		t.Errorf("picked %d and %d times, expected around 750 and 250", counts[paths[0]], counts[paths[1]])
+	}
+}
+
+func TestWeightedRandomNoFreeSpace(t *testing.T) {
+	paths := testPaths([2]uint64{0, 100}, [2]uint64{0, 100})
+	for i := 0; i < 100; i++ {
+		p := (weightedRandom{}).pick(paths)
+		if p != paths[0] && p != paths[1] {
+			t.Fatalf("picked %v, expected one of the candidates", p)
+		}
+	}
+}
+
+func TestPercentFull(t *testing.T) {
+	// the larger disk has more free space, but is more full
+	paths := testPaths([2]uint64{200, 1000}, [2]uint64{50, 100})
+	if p := (percentFull{}).pick(paths); p != paths[1] {
+		t.Errorf("picked %s, expected %s", p.path, paths[1].path)
+	}
+}
+
+func TestPercentFullNoTotalSpace(t *testing.T) {
+	// a path whose size is unknown is treated as full
+	paths := testPaths([2]uint64{50, 0}, [2]uint64{10, 100})
+	if p := (percentFull{}).pick(paths); p != paths[1] {
+		t.Errorf("picked %s, expected %s", p.path, paths[1].path)
+	}
+
+	// with none known, the first candidate is used
+	paths = testPaths([2]uint64{50, 0}, [2]uint64{10, 0})
+	if p := (percentFull{}).pick(paths); p != paths[0] {
+		t.Errorf("picked %s, expected %s", p.path, paths[0].path)
+	}
+}
@@ -4,32 +4,58 @@ package harvester
 
 import (
 	"cmp"
+	"os"
+	"path/filepath"
 	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/krobertson/chia-garden/pkg/types"
+
 	"golang.org/x/sys/unix"
 )
 
 type plotPath struct {
 	path       string
+	index      int
 	busy       atomic.Bool
 	paused     atomic.Bool
 	freeSpace  uint64
 	totalSpace uint64
+	plots      int
+	limits     pathLimits
+	labels     map[string]string
 	mutex      sync.Mutex
 }
 
 // updateFreeSpace will get the filesystem stats and update the free and total
-// space on the plotPath. This primarily should be done with the plotPath mutex
-// locked.
+// space on the plotPath, along with the number of plots stored on it. This
+// primarily should be done with the plotPath mutex locked.
 func (p *plotPath) updateFreeSpace() {
 	var stat unix.Statfs_t
 	unix.Statfs(p.path, &stat)
 
 	p.freeSpace = stat.Bavail * uint64(stat.Bsize)
 	p.totalSpace = stat.Blocks * uint64(stat.Bsize)
+
+	// count the plots, skipping partial transfers and any other files
+	if files, err := os.ReadDir(p.path); err == nil {
+		p.plots = 0
+		for _, de := range files {
+			if de.Type().IsRegular() && filepath.Ext(de.Name()) == "."+plotSuffix {
+				p.plots++
+			}
+		}
+	}
+}
+
+// freeRatio returns the fraction of the disk which is free.
+func (p *plotPath) freeRatio() float64 {
+	if p.totalSpace == 0 {
+		return 0
+	}
+	return float64(p.freeSpace) / float64(p.totalSpace)
 }
 
 // pause is used to temporarily pause selecting the specified path as an option
@@ -55,20 +81,36 @@ func (h *harvester) sortPaths() {
 }
 
 // pickPlot will return which plot path would be most ideal for the current
-// request. It will order the one with the most free space that doesn't already
-// have an active transfer.
-func (h *harvester) pickPlot() *plotPath {
+// request. The paths which don't already have an active transfer, have room
+// for the plot and whose labels satisfy the affinity rules for its attributes
+// are passed to the placement strategy to choose from. If none can be used, the
+// reason for declining the plot is returned instead.
+func (h *harvester) pickPlot(size uint64, attrs map[string]string) (*plotPath, string) {
 	h.sortMutex.Lock()
 	defer h.sortMutex.Unlock()
 
+	// when nothing is picked, the reason is the closest any path came to
+	// being usable, so a plotter knows whether it is worth retrying soon
+	reason := types.ReasonNoMatch
+	candidates := make([]*plotPath, 0, len(h.sortedPlots))
 	for _, v := range h.sortedPlots {
-		if v.busy.Load() {
+		if !v.allows(h.affinity, attrs) {
 			continue
 		}
-		if v.paused.Load() {
+		if !v.hasRoom(size) {
+			if reason == types.ReasonNoMatch {
+				reason = types.ReasonNoSpace
+			}
 			continue
 		}
-		return v
+		if v.busy.Load() || v.paused.Load() {
+			reason = types.ReasonBusy
+			continue
+		}
+		candidates = append(candidates, v)
+	}
+	if len(candidates) == 0 {
+		return nil, reason
 	}
-	return nil
+	return h.placement.pick(candidates), ""
 }
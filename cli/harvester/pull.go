@@ -0,0 +1,102 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package harvester
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/krobertson/chia-garden/pkg/transfer"
+	"github.com/krobertson/chia-garden/pkg/types"
+)
+
+// PlotPull is sent by a plotter which can't accept inbound connections after
+// it has picked this harvester. The store is validated and reserved the same
+// as a pushed plot, and then the plot is downloaded from the plotter in the
+// background. The result is reported back to the plotter's source URL.
+func (h *harvester) PlotPull(ctx context.Context, req *types.PlotPullRequest) (*types.PlotPullResponse, error) {
+	path := filepath.Join(req.Store, req.Name)
+
+	// validate the request and lock the plot path
+	plotPath, derr := h.reserveStore(path, int64(req.Size))
+	if derr != nil {
+		return nil, derr
+	}
+
+	go func() {
+		status := h.downloadPlot(plotPath, path, req)
+		h.releaseStore(plotPath)
+		reportPull(req.SourceUrl, status)
+	}()
+
+	return &types.PlotPullResponse{
+		Hostname: systemHostname,
+	}, nil
+}
+
+// downloadPlot fetches the plot from the plotter and stores it. It returns the
+// status code to report back to the plotter.
+func (h *harvester) downloadPlot(plotPath *plotPath, path string, req *types.PlotPullRequest) int {
+	peer := req.SourceUrl
+	if u, err := url.Parse(req.SourceUrl); err == nil {
+		peer = u.Host
+	}
+	progress := h.tracker.Start(req.Name, peer, int64(req.Size))
+	defer h.tracker.Finish(progress)
+
+	// abort the download if it stops making progress
+	ctx, stop := transfer.Watch(progress, stallTimeout, stallTimeout)
+	defer stop()
+
+	httpreq, err := http.NewRequestWithContext(ctx, "GET", req.SourceUrl, nil)
+	if err != nil {
+		log.Printf("Failed to pull plot %s: %v", req.Name, err)
+		return 502
+	}
+
+	resp, err := http.DefaultClient.Do(httpreq)
+	if err != nil {
+		log.Printf("Failed to pull plot %s: %v", req.Name, err)
+		return 502
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		log.Printf("Failed to pull plot %s, received %d status code", req.Name, resp.StatusCode)
+		return 502
+	}
+	if resp.ContentLength != int64(req.Size) {
+		log.Printf("Failed to pull plot %s, expected %d bytes but got %d", req.Name, req.Size, resp.ContentLength)
+		return 502
+	}
+
+	return h.receivePlot(plotPath, path, progress, &peerReader{transfer.CauseReader(ctx, resp.Body)})
+}
+
+// reportPull notifies the plotter of the result of pulling a plot. It will
+// retry a few times, since the plotter won't know the plot was stored
+// otherwise.
+func reportPull(url string, status int) {
+	for i := 0; i < 3; i++ {
+		httpreq, err := http.NewRequest("POST", url, nil)
+		if err != nil {
+			log.Printf("Failed to report pull result: %v", err)
+			return
+		}
+		httpreq.Header.Set(transfer.HeaderPullResult, strconv.Itoa(status))
+
+		httpresp, err := http.DefaultClient.Do(httpreq)
+		if err == nil {
+			httpresp.Body.Close()
+			return
+		}
+
+		log.Printf("Failed to report pull result, retrying: %v", err)
+		time.Sleep(5 * time.Second)
+	}
+}
@@ -0,0 +1,346 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package harvester
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/krobertson/chia-garden/pkg/transfer"
+	"github.com/krobertson/chia-garden/pkg/types"
+	"github.com/krobertson/chia-garden/pkg/utils"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	// uploadIdleTimeout is how long a multi-stream upload can go without any
+	// active streams before it is abandoned and the plot path released.
+	uploadIdleTimeout = 5 * time.Minute
+)
+
+// upload tracks a plot being received as multiple byte ranges over separate
+// requests. The plot path is held busy from when the first range arrives
+// until the upload is either committed or aborted.
+type upload struct {
+	path     string
+	tmpfile  string
+	size     int64
+	plotPath *plotPath
+	file     *os.File
+	start    time.Time
+	ranges   []transfer.Range
+	active   int
+	progress *transfer.Progress
+	timer    *time.Timer
+	mutex    sync.Mutex
+}
+
+// rangeHandler handles the requests for a multi-stream upload. Each range is
+// sent as a POST with a Content-Range header and written at its offset in the
+// preallocated temp file. Once all are sent, the plotter sends a commit
+// request listing the ranges and their checksums, which are verified before
+// the plot is moved into place.
+func (h *harvester) rangeHandler(w http.ResponseWriter, req *http.Request) {
+	if spec := req.Header.Get(transfer.HeaderCommitRanges); spec != "" {
+		h.commitUpload(w, req, spec)
+		return
+	}
+
+	r, size, err := transfer.ParseContentRange(req.Header.Get("Content-Range"))
+	if err != nil {
+		writeDecline(w, decline(400, types.ReasonInvalidRequest, "request to store %s with %v", req.URL.Path, err))
+		return
+	}
+	if req.ContentLength != r.Len() {
+		writeDecline(w, decline(411, types.ReasonInvalidRequest, "content length does not match range"))
+		return
+	}
+
+	u, derr := h.getUpload(req.URL.Path, size, req.RemoteAddr)
+	if derr != nil {
+		writeDecline(w, derr)
+		return
+	}
+
+	// perform the copy at the range's offset, computing the checksum of what
+	// was received
+	crc := crc32.New(transfer.Castagnoli)
+	dst := rangeWriter(u.file, r.Start)
+	body := newDeadlineReader(w, u.progress.Reader(req.Body))
+	n, err := io.Copy(dst, io.TeeReader(body, crc))
+	if err == nil && n != r.Len() {
+		err = fmt.Errorf("%w: %w", errInterrupted, io.ErrUnexpectedEOF)
+	}
+	if err == nil {
+		err = dst.Flush()
+	}
+
+	// check if another stream already aborted the upload before releasing ours
+	h.uploadsMutex.Lock()
+	aborted := h.uploads[u.path] != u
+	h.uploadsMutex.Unlock()
+
+	u.mutex.Lock()
+	u.active--
+	u.timer.Reset(uploadIdleTimeout)
+	if err == nil {
+		r.Checksum = crc.Sum32()
+		u.ranges = append(u.ranges, r)
+	}
+	u.mutex.Unlock()
+
+	if cerr := u.progress.Cancelled(); cerr != nil && err != nil {
+		log.Printf("Transfer of plot %s was cancelled, aborting", u.tmpfile)
+		h.abortUpload(u)
+		w.WriteHeader(410)
+		return
+	}
+	if errors.Is(err, transfer.ErrStalled) {
+		log.Printf("Transfer of range %d-%d of plot %s stalled, aborting: %v", r.Start, r.End, u.tmpfile, err)
+		h.abortUpload(u)
+		w.WriteHeader(408)
+		return
+	}
+	if errors.Is(err, errInterrupted) {
+		log.Printf("Transfer of range %d-%d of plot %s was interrupted, aborting: %v", r.Start, r.End, u.tmpfile, err)
+		h.abortUpload(u)
+		w.WriteHeader(400)
+		return
+	}
+	if err != nil && aborted {
+		w.WriteHeader(410)
+		return
+	}
+	if err != nil {
+		log.Printf("Failure while writing range %d-%d of plot %s: %v", r.Start, r.End, u.tmpfile, err)
+		h.abortUpload(u)
+		u.plotPath.pause()
+		w.WriteHeader(500)
+		return
+	}
+
+	w.WriteHeader(202)
+}
+
+// commitUpload verifies the ranges received for a multi-stream upload against
+// the ones sent by the plotter and then commits the plot.
+func (h *harvester) commitUpload(w http.ResponseWriter, req *http.Request, spec string) {
+	h.uploadsMutex.Lock()
+	u := h.uploads[req.URL.Path]
+	h.uploadsMutex.Unlock()
+	if u == nil {
+		log.Printf("Request to commit %s, but no upload is in progress", req.URL.Path)
+		w.WriteHeader(404)
+		return
+	}
+
+	sent, err := transfer.ParseRanges(spec)
+	if err != nil {
+		log.Printf("Request to commit %s with %v", req.URL.Path, err)
+		h.abortUpload(u)
+		w.WriteHeader(400)
+		return
+	}
+
+	// check the ranges and remove it from the active uploads under the same
+	// locks, so an idle timeout or a retried range can't abort it while it is
+	// being committed
+	h.uploadsMutex.Lock()
+	u.mutex.Lock()
+	current := h.uploads[u.path] == u
+	verified := u.active == 0 && verifyRanges(u.ranges, sent, u.size)
+	streams := len(u.ranges)
+	if current && verified {
+		delete(h.uploads, u.path)
+	}
+	u.mutex.Unlock()
+	h.uploadsMutex.Unlock()
+
+	if !current {
+		log.Printf("Request to commit %s, but the upload was already aborted", req.URL.Path)
+		w.WriteHeader(410)
+		return
+	}
+	if !verified {
+		log.Printf("Ranges received for %s do not match those sent, aborting", req.URL.Path)
+		h.abortUpload(u)
+		w.WriteHeader(422)
+		return
+	}
+
+	u.timer.Stop()
+	h.tracker.Finish(u.progress)
+	defer h.releaseStore(u.plotPath)
+
+	// flush and rename it so it can be used by the chia harvester
+	synced, err := commitPlot(u.file, u.tmpfile, u.path)
+	if err != nil {
+		log.Printf("Failed to commit final plot %s: %v", u.path, err)
+		u.file.Close()
+		os.Remove(u.tmpfile)
+		writeDecline(w, &types.TransferError{Status: 500, Reason: types.ReasonStorageFailure, Message: err.Error()})
+		u.plotPath.pause()
+		return
+	}
+
+	// log successful and some metrics
+	seconds := time.Since(u.start).Seconds()
+	log.Printf("Successfully stored %s (%s, %d streams, %f secs, %s/sec, %s sync)",
+		u.path, humanize.IBytes(uint64(u.size)), streams, seconds, humanize.Bytes(uint64(float64(u.size)/seconds)), synced.String())
+	w.WriteHeader(201)
+
+	// update free space
+	u.plotPath.updateFreeSpace()
+	h.sortPaths()
+}
+
+// abortHandler allows the plotter to abandon a multi-stream upload, such as
+// when one of its streams failed.
+func (h *harvester) abortHandler(w http.ResponseWriter, req *http.Request) {
+	h.uploadsMutex.Lock()
+	u := h.uploads[req.URL.Path]
+	h.uploadsMutex.Unlock()
+	if u == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	log.Printf("Plotter aborted upload of %s", req.URL.Path)
+	h.abortUpload(u)
+	w.WriteHeader(204)
+}
+
+// getUpload returns the in progress upload for the path, or starts a new one
+// if this is the first range received. A new upload goes through the same
+// validation as a regular transfer and holds the plot path until it finishes.
+func (h *harvester) getUpload(path string, size int64, peer string) (*upload, *types.TransferError) {
+	h.uploadsMutex.Lock()
+	defer h.uploadsMutex.Unlock()
+
+	if u, exists := h.uploads[path]; exists {
+		if u.size != size {
+			return nil, decline(409, types.ReasonConflict, "size of %s does not match upload in progress", path)
+		}
+		u.mutex.Lock()
+		u.active++
+		u.mutex.Unlock()
+		return u, nil
+	}
+
+	// validate the request and lock the plot path
+	plotPath, derr := h.reserveStore(path, size)
+	if derr != nil {
+		return nil, derr
+	}
+
+	// open and preallocate the file
+	tmpfile := path + ".tmp"
+	os.Remove(tmpfile)
+	// the ranges are written concurrently at their offsets, so the IO mode is
+	// applied to each range by rangeWriter rather than when opening the file
+	f, err := os.Create(tmpfile)
+	if err == nil {
+		err = utils.Preallocate(f, size)
+		if err != nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to open file at %s: %v", tmpfile, err)
+		os.Remove(tmpfile)
+		h.releaseStore(plotPath)
+		plotPath.pause()
+		return nil, &types.TransferError{Status: 500, Reason: types.ReasonStorageFailure, Message: err.Error()}
+	}
+
+	log.Printf("Receiving multi-stream plot at %s", path)
+	u := &upload{
+		path:     path,
+		tmpfile:  tmpfile,
+		size:     size,
+		plotPath: plotPath,
+		file:     f,
+		start:    time.Now(),
+		active:   1,
+		progress: h.tracker.Start(filepath.Base(path), peer, size),
+	}
+	u.timer = time.AfterFunc(uploadIdleTimeout, func() { h.expireUpload(u) })
+	context.AfterFunc(u.progress.Context(), func() {
+		if u.progress.Cancelled() != nil {
+			log.Printf("Upload of %s was cancelled, aborting", u.path)
+			h.abortUpload(u)
+		}
+	})
+	h.uploads[path] = u
+	return u, nil
+}
+
+// expireUpload is called when an upload has been idle for too long. If it
+// still has streams writing, it will check again later.
+func (h *harvester) expireUpload(u *upload) {
+	u.mutex.Lock()
+	active := u.active
+	if active > 0 {
+		u.timer.Reset(uploadIdleTimeout)
+	}
+	u.mutex.Unlock()
+
+	if active == 0 {
+		log.Printf("Upload of %s has been idle for %s, aborting", u.path, uploadIdleTimeout.String())
+		h.abortUpload(u)
+	}
+}
+
+// abortUpload removes the upload, deletes the partial file and releases the
+// plot path. It is safe to call multiple times.
+func (h *harvester) abortUpload(u *upload) {
+	h.uploadsMutex.Lock()
+	if h.uploads[u.path] != u {
+		h.uploadsMutex.Unlock()
+		return
+	}
+	delete(h.uploads, u.path)
+	h.uploadsMutex.Unlock()
+
+	u.timer.Stop()
+	h.tracker.Finish(u.progress)
+	u.file.Close()
+	os.Remove(u.tmpfile)
+	h.releaseStore(u.plotPath)
+}
+
+// verifyRanges checks that the received ranges exactly cover the file with no
+// gaps or overlaps, and that they match the ranges and checksums the plotter
+// sent.
+func verifyRanges(received, sent []transfer.Range, size int64) bool {
+	if len(received) != len(sent) {
+		return false
+	}
+
+	cmpStart := func(a, b transfer.Range) int {
+		return cmp.Compare(a.Start, b.Start)
+	}
+	slices.SortFunc(received, cmpStart)
+	slices.SortFunc(sent, cmpStart)
+
+	next := int64(0)
+	for i, r := range received {
+		if r != sent[i] || r.Start != next {
+			return false
+		}
+		next = r.End + 1
+	}
+	return next == size
+}
@@ -3,17 +3,24 @@
 package harvester
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/krobertson/chia-garden/pkg/transfer"
 	"github.com/krobertson/chia-garden/pkg/types"
+	"github.com/krobertson/chia-garden/pkg/utils"
 
 	"github.com/dustin/go-humanize"
 )
@@ -21,30 +28,94 @@ import (
 const (
 	taintTransfers = 10 * time.Millisecond
 	taintFreeSpace = 50 * time.Millisecond
+
+	// tokenExpiration is how long the signed URL returned for a plot request
+	// can be used to start sending it.
+	tokenExpiration = 24 * time.Hour
 )
 
 var (
 	systemHostname, _ = os.Hostname()
+	systemMachineId   = utils.GetMachineID()
 )
 
 type harvester struct {
-	plots       map[string]*plotPath
-	sortedPlots []*plotPath
-	sortMutex   sync.Mutex
-	hostPort    string
-	transfers   atomic.Int64
-	httpServer  *http.Server
+	plots        map[string]*plotPath
+	sortedPlots  []*plotPath
+	sortMutex    sync.Mutex
+	hostPort     string
+	transfers    atomic.Int64
+	httpServer   *http.Server
+	uploads      map[string]*upload
+	uploadsMutex sync.Mutex
+	streams      map[string]*stream
+	streamsMutex sync.Mutex
+	tracker      *transfer.Tracker
+	signer       *transfer.Signer
+	placement    placement
+	labels       map[string]string
+	affinity     []*affinityRule
+	tenancy      *tenancy
+	declined     map[string]int64
+	declineMutex sync.Mutex
+	draining     atomic.Bool
 }
 
 // newHarvester will create a the harvester server process and validate all of
 // the provided plot paths. It will return an error if any of the paths do not
 // exist, or are not a directory.
 func newHarvester(paths []string) (*harvester, error) {
+	signer, err := transfer.NewSigner()
+	if err != nil {
+		return nil, err
+	}
+	strategy, err := newPlacement(placementName)
+	if err != nil {
+		return nil, err
+	}
+	defaults, err := defaultLimits()
+	if err != nil {
+		return nil, err
+	}
+	limits, err := parsePathLimits(pathLimitSpecs, defaults)
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string)
+	for _, spec := range labelSpecs {
+		l, err := parseLabels(spec)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(labels, l)
+	}
+	pathLabels, err := parsePathLabels(pathLabelSpecs)
+	if err != nil {
+		return nil, err
+	}
+	affinity, err := parseAffinity(affinitySpecs)
+	if err != nil {
+		return nil, err
+	}
+	tenancy, err := newTenancy(farmerKeys, poolContracts)
+	if err != nil {
+		return nil, err
+	}
+
 	hostport := fmt.Sprintf("%s:%d", httpServerIP, httpServerPort)
 	h := &harvester{
 		plots:       make(map[string]*plotPath),
 		sortedPlots: make([]*plotPath, 0),
 		hostPort:    hostport,
+		uploads:     make(map[string]*upload),
+		streams:     make(map[string]*stream),
+		tracker:     transfer.NewTracker(systemHostname, "harvester"),
+		signer:      signer,
+		placement:   strategy,
+		labels:      labels,
+		affinity:    affinity,
+		tenancy:     tenancy,
+		declined:    make(map[string]int64),
 	}
 	log.Printf("Using http://%s for transfers...", hostport)
 
@@ -67,13 +138,18 @@ func newHarvester(paths []string) (*harvester, error) {
 			continue
 		}
 
-		pp := &plotPath{path: p}
+		pp := &plotPath{
+			path:   p,
+			index:  len(h.sortedPlots),
+			limits: lookupLimits(limits, p, defaults),
+			labels: lookupLabels(pathLabels, p, labels),
+		}
 		pp.updateFreeSpace()
 		h.plots[p] = pp
 		h.sortedPlots = append(h.sortedPlots, pp)
 
-		log.Printf("Registred plot path: %s [%s free / %s total]",
-			p, humanize.IBytes(pp.freeSpace), humanize.IBytes(pp.totalSpace))
+		log.Printf("Registred plot path: %s [%s free / %s total, %s reserved, %d plots]",
+			p, humanize.IBytes(pp.freeSpace), humanize.IBytes(pp.totalSpace), humanize.IBytes(pp.reserved()), pp.plots)
 	}
 
 	// ensure we have at least one
@@ -86,8 +162,10 @@ func newHarvester(paths []string) (*harvester, error) {
 
 	// set up the http server
 	h.httpServer = &http.Server{
-		Addr:    fmt.Sprintf(":%d", httpServerPort),
-		Handler: http.DefaultServeMux,
+		Addr:              fmt.Sprintf(":%d", httpServerPort),
+		Handler:           http.DefaultServeMux,
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
 	}
 	http.HandleFunc("/", h.httpHandler)
 	go h.httpServer.ListenAndServe()
@@ -99,42 +177,118 @@ func newHarvester(paths []string) (*harvester, error) {
 // harvester. It will generate a response, but then momentarily sleep as a
 // slight taint to allow the most ideal system to originally respond the
 // fastest.
-func (h *harvester) PlotReady(req *types.PlotRequest) (*types.PlotResponse, error) {
+func (h *harvester) PlotReady(ctx context.Context, req *types.PlotRequest) (*types.PlotResponse, error) {
+	// skip if a transfer to this host recently stalled
+	if slices.Contains(req.Exclude, systemHostname) {
+		return nil, nil
+	}
+
+	// let plotters know to look elsewhere while shutting down
+	if h.draining.Load() {
+		return nil, h.refuse(types.ReasonDraining, "harvester %s is shutting down", systemHostname)
+	}
+
+	// only accept plots for the configured farmer keys or pool contracts
+	if err := h.tenancy.check(req.Attributes); err != nil {
+		log.Printf("Declining plot %s, it belongs to another farm: %v", req.Name, err)
+		return nil, h.refuse(types.ReasonForeignPlot, "plot belongs to another farm: %v", err)
+	}
+
 	// check if we're maxed on concurrent transfers
 	if h.transfers.Load() >= maxTransfers {
-		return nil, nil
+		return nil, h.refuse(types.ReasonMaxTransfers, "harvester %s already has %d transfers", systemHostname, maxTransfers)
 	}
 
-	// pick a plot. This should return the one with the most free space that
-	// isn't busy.
-	plot := h.pickPlot()
-	if plot == nil {
-		return nil, nil
+	// don't offer to store a plot we already have, such as another replica
+	if h.hasPlot(req.Name) {
+		return nil, h.refuse(types.ReasonExists, "harvester %s already has plot %s", systemHostname, req.Name)
 	}
 
-	// check if we have enough free space
-	if plot.freeSpace <= req.Size {
-		return nil, nil
+	// pick a plot path which isn't busy, has enough free space and matches
+	// the plot's affinity, based on the placement strategy
+	plot, reason := h.pickPlot(req.Size, req.Attributes)
+	if plot == nil {
+		switch reason {
+		case types.ReasonBusy:
+			return nil, h.refuse(reason, "all paths with room for the plot on %s are busy", systemHostname)
+		case types.ReasonNoSpace:
+			return nil, h.refuse(reason, "no paths on %s have room for the plot", systemHostname)
+		default:
+			return nil, h.refuse(reason, "no paths on %s match the plot's affinity", systemHostname)
+		}
 	}
 
-	// generate response
+	// generate response, with a signed url so only the plotter can send it
+	path := filepath.Join(plot.path, req.Name)
 	resp := &types.PlotResponse{
-		Hostname: systemHostname,
-		Store:    plot.path,
-		Url:      fmt.Sprintf("http://%s%s", h.hostPort, filepath.Join(plot.path, req.Name)),
+		Hostname:  systemHostname,
+		MachineId: systemMachineId,
+		Store:     plot.path,
+		Url:       fmt.Sprintf("http://%s%s?%s", h.hostPort, path, h.signer.Query(path, tokenExpiration)),
 	}
 
-	// generate and handle the taint
+	// generate and handle the taint, giving up if the plotter stops waiting
+	// or we're shutting down
 	d := h.generateTaint(plot)
 	log.Printf("Responding to plot request after %s taint", d.String())
-	time.Sleep(d)
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+		log.Printf("Plot request for %s was abandoned during the taint: %v", req.Name, ctx.Err())
+		return nil, ctx.Err()
+	}
 	return resp, nil
 }
 
 // PlotLocate is used to check if any harvesters have the specified plot. This
 // is primarily used when a plotter is starting up and has some existing plots
-// present. Returns a nil PlotLocateResponse if the plot does not exist.
-func (h *harvester) PlotLocate(req *types.PlotLocateRequest) (*types.PlotLocateResponse, error) {
+// present. Returns a nil PlotLocateResponse if the plot does not exist, or an
+// error if it exists with a different size.
+func (h *harvester) PlotLocate(ctx context.Context, req *types.PlotLocateRequest) (*types.PlotLocateResponse, error) {
+	found, mismatch := h.locate(req)
+	if found {
+		return &types.PlotLocateResponse{
+			Hostname: systemHostname,
+		}, nil
+	}
+	if mismatch != nil {
+		return nil, &types.TransferError{Reason: types.ReasonSizeMismatch, Message: mismatch.Error()}
+	}
+	return nil, nil
+}
+
+// PlotLocateBatch is the same as PlotLocate, but for many plots at once, so a
+// plotter with a large backlog can check them all with a single request.
+// Returns a nil PlotLocateBatchResponse if none of the plots exist.
+func (h *harvester) PlotLocateBatch(ctx context.Context, req *types.PlotLocateBatchRequest) (*types.PlotLocateBatchResponse, error) {
+	resp := &types.PlotLocateBatchResponse{
+		Hostname: systemHostname,
+	}
+	for _, plot := range req.Plots {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		found, mismatch := h.locate(plot)
+		switch {
+		case found:
+			resp.Found = append(resp.Found, plot.Name)
+		case mismatch != nil:
+			resp.Mismatched = append(resp.Mismatched, plot.Name)
+		}
+	}
+
+	if len(resp.Found) == 0 && len(resp.Mismatched) == 0 {
+		return nil, nil
+	}
+	return resp, nil
+}
+
+// locate returns whether the plot is on any of the plot paths with the expected
+// size. If it is only found with a different size, an error describing the
+// mismatch is returned.
+func (h *harvester) locate(req *types.PlotLocateRequest) (bool, error) {
+	var mismatch error
 	for k := range h.plots {
 		fullpath := filepath.Join(k, req.Name)
 		fi, err := os.Stat(fullpath)
@@ -147,127 +301,340 @@ func (h *harvester) PlotLocate(req *types.PlotLocateRequest) (*types.PlotLocateR
 		// check other errors
 		if err != nil {
 			log.Printf("Error checking for file %s: %v", fullpath, err)
+			continue
 		}
 
 		// check the size to see if it is a match
 		if fi.Size() == int64(req.Size) {
-			return &types.PlotLocateResponse{
-				Hostname: systemHostname,
-			}, nil
+			return true, nil
 		}
 
 		log.Printf("IMPORTANT: Processed PlotLocate request for %q and sizes did not match. Check validity of the plot file.", fullpath)
+		mismatch = fmt.Errorf("plot %s on %s is %d bytes, expected %d", req.Name, systemHostname, fi.Size(), req.Size)
 	}
+	return false, mismatch
+}
 
-	return nil, nil
+// TransferCancel is sent by an operator to abort any transfers of the plot. The
+// partial file is removed and the plot path released by the transfer itself
+// once it notices it was cancelled.
+func (h *harvester) TransferCancel(req *types.TransferCancelRequest) *types.TransferCancelResponse {
+	n := h.tracker.Cancel(req.Name, fmt.Errorf("%w by request", transfer.ErrCancelled))
+	if n == 0 {
+		return nil
+	}
+
+	log.Printf("Cancelled %d transfers of plot %s", n, req.Name)
+	return &types.TransferCancelResponse{
+		Hostname:  systemHostname,
+		Role:      "harvester",
+		Cancelled: n,
+	}
+}
+
+// refuse returns an error declining a plot request, and counts it towards the
+// harvester's status. Unlike decline, it isn't logged, since every harvester
+// sees each request and most are expected to be declined.
+func (h *harvester) refuse(reason, format string, args ...any) error {
+	h.countDecline(reason)
+	return &types.TransferError{
+		Reason:  reason,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// countDecline records a plot request declined for the reason, which is
+// reported in the status.
+func (h *harvester) countDecline(reason string) {
+	h.declineMutex.Lock()
+	h.declined[reason]++
+	h.declineMutex.Unlock()
+}
+
+// hasPlot returns whether a plot with the name is on any of the plot paths.
+func (h *harvester) hasPlot(name string) bool {
+	for k := range h.plots {
+		if _, err := os.Stat(filepath.Join(k, name)); err == nil {
+			return true
+		}
+	}
+	return false
 }
 
 // httpHandler faciliates the transfer of plot files from the plotters to the
 // harvesters. It encapculates a single request and is ran within its own
 // goroutine. It will respond with a 201 on success and a relevant error code on
 // failure. A failure should trigger the plotter to re-request storage.
+//
+// Plotters send "Expect: 100-continue", and the body is only read once the
+// request has been validated and the plot path reserved. This means a request
+// which is declined is rejected before the plotter sends any of the plot, and
+// the reason is reported back in the response body.
 func (h *harvester) httpHandler(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 
-	// get the plot path and ensure it exists
-	base := filepath.Dir(req.URL.Path)
-	plotPath, exists := h.plots[base]
-	if !exists {
-		log.Printf("Request to store in %s, but does not exist", base)
-		w.WriteHeader(404)
+	// status, aborts and multi-stream uploads are handled separately
+	if req.Method == http.MethodGet && req.URL.Path == "/status" {
+		h.statusHandler(w, req)
 		return
 	}
-
-	// check if we're maxed on concurrent transfers
-	if h.transfers.Load() >= maxTransfers {
-		log.Printf("Request to store in %s, but at max transfers", base)
-		w.WriteHeader(503)
+	if !h.signer.Verify(req.URL.Path, req.URL.Query()) {
+		writeDecline(w, decline(403, types.ReasonInvalidToken, "invalid or expired token for %s", req.URL.Path))
 		return
 	}
-
-	// make sure the disk isn't already being written to. this helps to avoid
-	// file fragmentation
-	if plotPath.busy.Load() {
-		log.Printf("Request to store %s, but already trasnferring", req.URL.Path)
-		w.WriteHeader(503)
+	if req.Method == http.MethodDelete {
+		h.abortHandler(w, req)
 		return
 	}
-
-	// make sure we have the content length
-	if req.ContentLength == 0 {
-		w.WriteHeader(411)
+	if req.Header.Get("Content-Range") != "" || req.Header.Get(transfer.HeaderCommitRanges) != "" {
+		h.rangeHandler(w, req)
 		return
 	}
 
-	// lock the file path
-	plotPath.mutex.Lock()
-	defer plotPath.mutex.Unlock()
-	plotPath.busy.Store(true)
-	defer plotPath.busy.Store(false)
-	h.transfers.Add(1)
-	defer h.transfers.Add(-1)
-
-	// check if we have enough free space
-	if plotPath.freeSpace <= uint64(req.ContentLength) {
-		log.Printf("Request to store %s, but not enough space (%s / %s)",
-			req.URL.Path, humanize.Bytes(uint64(req.ContentLength)), humanize.Bytes(plotPath.freeSpace))
-		w.WriteHeader(413)
+	// make sure we have the content length
+	if req.ContentLength <= 0 {
+		writeDecline(w, decline(411, types.ReasonInvalidRequest, "content length is required"))
 		return
 	}
 
-	// validate the file doesn't already exist, as a safeguard
-	fi, _ := os.Stat(req.URL.Path)
-	if fi != nil {
-		log.Printf("File at %s already exists", req.URL.Path)
-		w.WriteHeader(409)
+	// validate the request and lock the plot path
+	plotPath, derr := h.reserveStore(req.URL.Path, req.ContentLength)
+	if derr != nil {
+		writeDecline(w, derr)
 		return
 	}
+	defer h.releaseStore(plotPath)
+
+	progress := h.tracker.Start(filepath.Base(req.URL.Path), req.RemoteAddr, req.ContentLength)
+	defer h.tracker.Finish(progress)
 
+	body := newDeadlineReader(w, req.Body)
+	w.WriteHeader(h.receivePlot(plotPath, req.URL.Path, progress, body))
+}
+
+// receivePlot will write the plot from the reader to a temporary file and then
+// commit it to its final path. The plot path must already be reserved. It
+// returns the status code to report back to the plotter.
+func (h *harvester) receivePlot(plotPath *plotPath, path string, progress *transfer.Progress, r io.Reader) int {
 	// open the file and transfer
-	tmpfile := req.URL.Path + ".tmp"
+	tmpfile := path + ".tmp"
 	os.Remove(tmpfile)
-	f, err := os.Create(tmpfile)
+	f, fw, err := createPlotFile(tmpfile)
 	if err != nil {
 		log.Printf("Failed to open file at %s: %v", tmpfile, err)
-		w.WriteHeader(500)
 		plotPath.pause()
-		return
+		return 500
 	}
 	defer f.Close()
 
 	// perform the copy
-	log.Printf("Receiving plot at %s", req.URL.Path)
+	log.Printf("Receiving plot at %s", path)
 	start := time.Now()
-	bytes, err := io.Copy(f, req.Body)
+	bytes, err := io.Copy(fw, progress.Reader(r))
+	if err == nil {
+		err = fw.Flush()
+	}
+	if errors.Is(err, transfer.ErrCancelled) {
+		log.Printf("Transfer of plot %s was cancelled, aborting", tmpfile)
+		f.Close()
+		os.Remove(tmpfile)
+		return 410
+	}
+	if errors.Is(err, transfer.ErrStalled) {
+		log.Printf("Transfer of plot %s stalled, aborting: %v", tmpfile, err)
+		f.Close()
+		os.Remove(tmpfile)
+		return 408
+	}
+	if errors.Is(err, errInterrupted) {
+		log.Printf("Transfer of plot %s was interrupted, aborting: %v", tmpfile, err)
+		f.Close()
+		os.Remove(tmpfile)
+		return 400
+	}
 	if err != nil {
 		log.Printf("Failure while writing plot %s: %v", tmpfile, err)
 		f.Close()
 		os.Remove(tmpfile)
-		w.WriteHeader(500)
 		plotPath.pause()
-		return
+		return 500
 	}
 
-	// rename it so it can be used by the chia harvester
-	err = os.Rename(tmpfile, req.URL.Path)
+	// flush and rename it so it can be used by the chia harvester
+	synced, err := commitPlot(f, tmpfile, path)
 	if err != nil {
-		log.Printf("Failed to rename final plot %s: %v", req.URL.Path, err)
+		log.Printf("Failed to commit final plot %s: %v", path, err)
 		f.Close()
 		os.Remove(tmpfile)
-		w.WriteHeader(500)
 		plotPath.pause()
-		return
+		return 500
 	}
 
 	// log successful and some metrics
 	seconds := time.Since(start).Seconds()
-	log.Printf("Successfully stored %s (%s, %f secs, %s/sec)",
-		req.URL.Path, humanize.IBytes(uint64(bytes)), seconds, humanize.Bytes(uint64(float64(bytes)/seconds)))
-	w.WriteHeader(201)
+	log.Printf("Successfully stored %s (%s, %f secs, %s/sec, %s sync)",
+		path, humanize.IBytes(uint64(bytes)), seconds, humanize.Bytes(uint64(float64(bytes)/seconds)), synced.String())
 
 	// update free space
 	plotPath.updateFreeSpace()
 	h.sortPaths()
+	return 201
+}
+
+// statusHandler reports the active transfers and state of each plot path.
+func (h *harvester) statusHandler(w http.ResponseWriter, req *http.Request) {
+	status := &types.HarvesterStatus{
+		Hostname:  systemHostname,
+		Url:       fmt.Sprintf("http://%s", h.hostPort),
+		Labels:    h.labels,
+		Transfers: h.tracker.List(),
+		Paths:     make([]*types.PathStatus, 0, len(h.plots)),
+	}
+
+	h.declineMutex.Lock()
+	status.Declined = maps.Clone(h.declined)
+	h.declineMutex.Unlock()
+
+	h.sortMutex.Lock()
+	for _, p := range h.sortedPlots {
+		status.Paths = append(status.Paths, &types.PathStatus{
+			Path:       p.path,
+			FreeSpace:  p.freeSpace,
+			TotalSpace: p.totalSpace,
+			Reserved:   p.reserved(),
+			Plots:      p.plots,
+			MaxPlots:   p.limits.maxPlots,
+			Labels:     p.labels,
+			Busy:       p.busy.Load(),
+			Paused:     p.paused.Load(),
+		})
+	}
+	h.sortMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// reserveStore validates a request to store a plot at the specified path and,
+// if it is acceptable, locks the plot path and marks it as busy. It returns an
+// error with the status code and reason to respond with if the request cannot
+// be accepted. releaseStore must be called once the transfer is finished.
+func (h *harvester) reserveStore(path string, size int64) (*plotPath, *types.TransferError) {
+	// get the plot path and ensure it exists
+	base := filepath.Dir(path)
+	plotPath, exists := h.plots[base]
+	if !exists {
+		return nil, decline(404, types.ReasonUnknownPath, "plot path %s does not exist", base)
+	}
+
+	// check if we're maxed on concurrent transfers
+	if h.transfers.Load() >= maxTransfers {
+		return nil, decline(503, types.ReasonMaxTransfers, "already at max transfers")
+	}
+
+	// make sure the disk isn't already being written to and lock it. this
+	// helps to avoid file fragmentation. it must not block, as multi-stream
+	// uploads reserve the path while holding the uploads lock
+	if !plotPath.mutex.TryLock() {
+		return nil, decline(503, types.ReasonBusy, "plot path %s is already transferring", base)
+	}
+	plotPath.busy.Store(true)
+	h.transfers.Add(1)
+
+	// check if we have enough free space outside of the reserve, and haven't
+	// reached the max plots
+	if plotPath.full() {
+		h.releaseStore(plotPath)
+		return nil, decline(413, types.ReasonNoSpace, "plot path %s already has %d plots", base, plotPath.plots)
+	}
+	if !plotPath.hasRoom(uint64(size)) {
+		h.releaseStore(plotPath)
+		return nil, decline(413, types.ReasonNoSpace, "not enough space for %s (%s / %s, %s reserved)",
+			path, humanize.Bytes(uint64(size)), humanize.Bytes(plotPath.freeSpace), humanize.Bytes(plotPath.reserved()))
+	}
+
+	// validate the file doesn't already exist, as a safeguard
+	fi, _ := os.Stat(path)
+	if fi != nil {
+		h.releaseStore(plotPath)
+		return nil, decline(409, types.ReasonExists, "file at %s already exists", path)
+	}
+
+	return plotPath, nil
+}
+
+// releaseStore unlocks a plot path previously returned by reserveStore.
+func (h *harvester) releaseStore(plotPath *plotPath) {
+	h.transfers.Add(-1)
+	plotPath.busy.Store(false)
+	plotPath.mutex.Unlock()
+}
+
+// decline logs and returns an error for a request to store a plot which is
+// being turned down.
+func decline(status int, reason, format string, args ...any) *types.TransferError {
+	err := &types.TransferError{
+		Status:  status,
+		Reason:  reason,
+		Message: fmt.Sprintf(format, args...),
+	}
+	log.Printf("Declining request to store plot: %s", err.Message)
+	return err
+}
+
+// writeDecline responds to a request with the error's status code and the
+// error itself as the body.
+func writeDecline(w http.ResponseWriter, err *types.TransferError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.Status)
+	json.NewEncoder(w).Encode(err)
+}
+
+// errInterrupted is returned when reading the plot from the plotter fails, such
+// as it disconnecting. This is not a problem with the disk, so the plot path is
+// not paused.
+var errInterrupted = errors.New("transfer interrupted")
+
+// deadlineReader extends the read deadline on the connection before each read
+// of the request body, so a transfer is only aborted once it stops making
+// progress rather than after a fixed amount of time. Other read errors are
+// returned as errInterrupted.
+type deadlineReader struct {
+	r  io.Reader
+	rc *http.ResponseController
+}
+
+func newDeadlineReader(w http.ResponseWriter, r io.Reader) *deadlineReader {
+	return &deadlineReader{r: r, rc: http.NewResponseController(w)}
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	d.rc.SetReadDeadline(time.Now().Add(stallTimeout))
+	n, err := d.r.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = fmt.Errorf("%w: no data in %s", transfer.ErrStalled, stallTimeout.String())
+	}
+	return n, peerError(err)
+}
+
+// peerReader wraps a reader for a plot coming from a plotter, returning errors
+// reading it as errInterrupted.
+type peerReader struct {
+	r io.Reader
+}
+
+func (p *peerReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	return n, peerError(err)
+}
+
+// peerError wraps an error reading a plot from the plotter as errInterrupted,
+// unless the transfer ended, stalled or was cancelled.
+func peerError(err error) error {
+	if err == nil || err == io.EOF || errors.Is(err, transfer.ErrStalled) || errors.Is(err, transfer.ErrCancelled) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", errInterrupted, err)
 }
 
 // generateTaint will calculate how long to delay the response based on current
@@ -0,0 +1,285 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package harvester
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/krobertson/chia-garden/pkg/transfer"
+	"github.com/krobertson/chia-garden/pkg/types"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	// streamIdleTimeout is how long a NATS stream can go without receiving a
+	// chunk before it is abandoned and the plot path released.
+	streamIdleTimeout = 5 * time.Minute
+)
+
+// stream tracks a plot being received as chunks over NATS. Chunks must arrive
+// in order, and a running checksum is kept of everything written so it can be
+// verified when the plotter commits the plot.
+type stream struct {
+	path     string
+	tmpfile  string
+	size     int64
+	offset   int64
+	plotPath *plotPath
+	file     *os.File
+	hash     hash.Hash
+	start    time.Time
+	progress *transfer.Progress
+	timer    *time.Timer
+	mutex    sync.Mutex
+}
+
+// PlotStreamStart begins receiving a plot over NATS, for plotters that can't
+// reach the harvester's HTTP server. If the stream is already in progress, or a
+// partial temp file was left behind, such as by the harvester restarting, it
+// returns the offset to resume from.
+func (h *harvester) PlotStreamStart(ctx context.Context, req *types.PlotStreamRequest) (*types.PlotStreamResponse, error) {
+	path := filepath.Join(req.Store, req.Name)
+
+	h.streamsMutex.Lock()
+	defer h.streamsMutex.Unlock()
+
+	// resume a stream in progress
+	if s, exists := h.streams[path]; exists {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.size != int64(req.Size) {
+			return nil, fmt.Errorf("stream for %s already in progress with a different size", path)
+		}
+		s.timer.Reset(streamIdleTimeout)
+		log.Printf("Resuming stream of plot %s at %s", path, humanize.IBytes(uint64(s.offset)))
+		return &types.PlotStreamResponse{
+			Hostname: systemHostname,
+			Offset:   uint64(s.offset),
+		}, nil
+	}
+
+	// validate the request and lock the plot path
+	plotPath, derr := h.reserveStore(path, int64(req.Size))
+	if derr != nil {
+		return nil, derr
+	}
+
+	s, err := openStream(plotPath, path, int64(req.Size))
+	if err != nil {
+		log.Printf("Failed to open stream for plot %s: %v", path, err)
+		h.releaseStore(plotPath)
+		plotPath.pause()
+		return nil, err
+	}
+	s.progress = h.tracker.Start(req.Name, "nats", s.size)
+	s.progress.Set(s.offset)
+	s.timer = time.AfterFunc(streamIdleTimeout, func() { h.expireStream(s) })
+	context.AfterFunc(s.progress.Context(), func() {
+		if s.progress.Cancelled() != nil {
+			log.Printf("Plot stream %s was cancelled, aborting", s.path)
+			h.abortStream(s)
+		}
+	})
+	h.streams[path] = s
+
+	if s.offset > 0 {
+		log.Printf("Resuming plot stream at %s from %s", path, humanize.IBytes(uint64(s.offset)))
+	} else {
+		log.Printf("Receiving plot stream at %s", path)
+	}
+
+	return &types.PlotStreamResponse{
+		Hostname: systemHostname,
+		Offset:   uint64(s.offset),
+	}, nil
+}
+
+// openStream opens the temporary file for a stream. If a partial file already
+// exists, it is kept and checksummed so the transfer can resume from its end.
+func openStream(plotPath *plotPath, path string, size int64) (*stream, error) {
+	tmpfile := path + ".tmp"
+	f, err := os.OpenFile(tmpfile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// discard anything that can't be a prefix of this plot
+	offset := fi.Size()
+	if offset > size {
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		offset = 0
+	}
+
+	// checksum the data already received
+	hash := sha256.New()
+	if offset > 0 {
+		if _, err := io.Copy(hash, io.NewSectionReader(f, 0, offset)); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return &stream{
+		path:     path,
+		tmpfile:  tmpfile,
+		size:     size,
+		offset:   offset,
+		plotPath: plotPath,
+		file:     f,
+		hash:     hash,
+		start:    time.Now(),
+	}, nil
+}
+
+// PlotStreamChunk writes a chunk of a plot being streamed. If the chunk isn't
+// at the expected offset, such as a message being dropped, it is ignored and
+// the expected offset is returned so the plotter can rewind.
+func (h *harvester) PlotStreamChunk(ctx context.Context, chunk *types.PlotStreamChunk) (*types.PlotStreamAck, error) {
+	path := filepath.Join(chunk.Store, chunk.Name)
+
+	h.streamsMutex.Lock()
+	s := h.streams[path]
+	h.streamsMutex.Unlock()
+	if s == nil {
+		return nil, fmt.Errorf("no stream in progress for %s", path)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.timer.Reset(streamIdleTimeout)
+
+	if int64(chunk.Offset) != s.offset {
+		return &types.PlotStreamAck{Offset: uint64(s.offset)}, nil
+	}
+	if s.offset+int64(len(chunk.Data)) > s.size {
+		return nil, fmt.Errorf("chunk exceeds the size of plot %s", path)
+	}
+
+	n, err := s.file.WriteAt(chunk.Data, s.offset)
+	if err != nil {
+		log.Printf("Failure while writing plot %s: %v", s.tmpfile, err)
+		go h.abortStream(s)
+		s.plotPath.pause()
+		return nil, err
+	}
+	s.hash.Write(chunk.Data[:n])
+	s.offset += int64(n)
+	s.progress.Add(int64(n))
+
+	return &types.PlotStreamAck{Offset: uint64(s.offset)}, nil
+}
+
+// PlotStreamCommit verifies the plot has been fully received with a matching
+// checksum and then commits it. The status matches what would have been
+// returned for a plot sent over HTTP.
+func (h *harvester) PlotStreamCommit(ctx context.Context, commit *types.PlotStreamCommit) (*types.PlotStreamResult, error) {
+	path := filepath.Join(commit.Store, commit.Name)
+
+	h.streamsMutex.Lock()
+	s := h.streams[path]
+	if s != nil {
+		delete(h.streams, path)
+	}
+	h.streamsMutex.Unlock()
+	if s == nil {
+		return nil, fmt.Errorf("no stream in progress for %s", path)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.timer.Stop()
+	h.tracker.Finish(s.progress)
+	defer h.releaseStore(s.plotPath)
+
+	// verify the plot
+	checksum := hex.EncodeToString(s.hash.Sum(nil))
+	if s.offset != s.size || checksum != commit.Checksum {
+		log.Printf("Plot stream %s failed verification (%d of %d bytes, checksum %s expected %s)",
+			path, s.offset, s.size, checksum, commit.Checksum)
+		s.file.Close()
+		os.Remove(s.tmpfile)
+		return &types.PlotStreamResult{Status: 422}, nil
+	}
+
+	// flush and rename it so it can be used by the chia harvester
+	synced, err := commitPlot(s.file, s.tmpfile, s.path)
+	if err != nil {
+		log.Printf("Failed to commit final plot %s: %v", s.path, err)
+		s.file.Close()
+		os.Remove(s.tmpfile)
+		s.plotPath.pause()
+		return &types.PlotStreamResult{Status: 500}, nil
+	}
+
+	// log successful and some metrics
+	seconds := time.Since(s.start).Seconds()
+	log.Printf("Successfully stored %s over NATS (%s, %f secs, %s/sec, %s sync)",
+		s.path, humanize.IBytes(uint64(s.size)), seconds, humanize.Bytes(uint64(float64(s.size)/seconds)), synced.String())
+
+	// update free space
+	s.plotPath.updateFreeSpace()
+	h.sortPaths()
+	return &types.PlotStreamResult{Status: 201}, nil
+}
+
+// PlotStreamAbort is called by the plotter to abandon a stream.
+func (h *harvester) PlotStreamAbort(ctx context.Context, req *types.PlotStreamRequest) error {
+	path := filepath.Join(req.Store, req.Name)
+
+	h.streamsMutex.Lock()
+	s := h.streams[path]
+	h.streamsMutex.Unlock()
+	if s == nil {
+		return nil
+	}
+
+	log.Printf("Plotter aborted stream of %s", path)
+	h.abortStream(s)
+	return nil
+}
+
+// expireStream is called when a stream has not received a chunk in too long.
+func (h *harvester) expireStream(s *stream) {
+	log.Printf("Plot stream %s has been idle for %s, aborting", s.path, streamIdleTimeout.String())
+	h.abortStream(s)
+}
+
+// abortStream closes the stream, removes the partial file and releases the
+// plot path. It is safe to call multiple times.
+func (h *harvester) abortStream(s *stream) {
+	h.streamsMutex.Lock()
+	if h.streams[s.path] != s {
+		h.streamsMutex.Unlock()
+		return
+	}
+	delete(h.streams, s.path)
+	h.streamsMutex.Unlock()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.timer.Stop()
+	h.tracker.Finish(s.progress)
+	s.file.Close()
+	os.Remove(s.tmpfile)
+	h.releaseStore(s.plotPath)
+}
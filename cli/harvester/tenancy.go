@@ -0,0 +1,70 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package harvester
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/krobertson/chia-garden/pkg/plot"
+)
+
+// tenancy restricts the harvester to plots for specific farmer public keys or
+// pool contracts, so farms sharing the same NATS bus and hardware don't store
+// each other's plots.
+type tenancy struct {
+	farmerKeys    map[string]bool
+	poolContracts map[string]bool
+}
+
+// newTenancy parses the accepted farmer public keys and pool contracts. It
+// returns nil if none are configured, in which case all plots are accepted.
+func newTenancy(farmerKeys, poolContracts []string) (*tenancy, error) {
+	if len(farmerKeys) == 0 && len(poolContracts) == 0 {
+		return nil, nil
+	}
+
+	t := &tenancy{
+		farmerKeys:    make(map[string]bool),
+		poolContracts: make(map[string]bool),
+	}
+	for _, s := range farmerKeys {
+		b, err := plot.ParsePublicKey(s)
+		if err != nil {
+			return nil, err
+		}
+		t.farmerKeys[hex.EncodeToString(b)] = true
+	}
+	for _, s := range poolContracts {
+		b, err := plot.ParsePuzzleHash(s)
+		if err != nil {
+			return nil, err
+		}
+		t.poolContracts[hex.EncodeToString(b)] = true
+	}
+	return t, nil
+}
+
+// check returns an error explaining why the plot doesn't belong on this
+// harvester, or nil if it is for one of the accepted farmer keys or pool
+// contracts.
+func (t *tenancy) check(attrs map[string]string) error {
+	if t == nil {
+		return nil
+	}
+
+	farmerKey := attrs[plot.AttrFarmerKey]
+	poolContract := attrs[plot.AttrPoolContract]
+	if t.farmerKeys[farmerKey] || t.poolContracts[poolContract] {
+		return nil
+	}
+
+	switch {
+	case farmerKey == "" && poolContract == "":
+		return fmt.Errorf("the plot's farmer key and pool contract are unknown")
+	case poolContract == "":
+		return fmt.Errorf("farmer key %s is not accepted", farmerKey)
+	default:
+		return fmt.Errorf("farmer key %s and pool contract %s are not accepted", farmerKey, poolContract)
+	}
+}
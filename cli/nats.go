@@ -0,0 +1,66 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package cli
+
+import (
+	"log"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Connect connects to NATS with the configured authentication, TLS and
+// reconnect options, which are shared by all of the commands. The name
+// identifies the connection unless another is configured. A custom inbox
+// prefix allows replies to be received on accounts whose permissions don't
+// allow the default _INBOX subjects.
+func Connect(name string) (*nats.Conn, error) {
+	if natsName != "" {
+		name = natsName
+	}
+	opts := []nats.Option{
+		nats.Name(name),
+		nats.MaxReconnects(natsMaxReconnects),
+		nats.ReconnectWait(natsReconnectWait),
+		nats.ReconnectJitter(natsReconnectJitter, natsReconnectJitter),
+		nats.Timeout(natsTimeout),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				log.Printf("Disconnected from NATS: %v", err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Printf("Reconnected to NATS at %s", nc.ConnectedUrlRedacted())
+		}),
+	}
+
+	// authentication
+	if natsCreds != "" {
+		opts = append(opts, nats.UserCredentials(natsCreds))
+	}
+	if natsNkey != "" {
+		opt, err := nats.NkeyOptionFromSeed(natsNkey)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	}
+	if natsUser != "" {
+		opts = append(opts, nats.UserInfo(natsUser, natsPassword))
+	}
+	if natsToken != "" {
+		opts = append(opts, nats.Token(natsToken))
+	}
+
+	// tls
+	if natsTLSCert != "" || natsTLSKey != "" {
+		opts = append(opts, nats.ClientCert(natsTLSCert, natsTLSKey))
+	}
+	if natsTLSCA != "" {
+		opts = append(opts, nats.RootCAs(natsTLSCA))
+	}
+
+	if InboxPrefix != "" {
+		opts = append(opts, nats.CustomInboxPrefix(InboxPrefix))
+	}
+	return nats.Connect(NatsUrl, opts...)
+}
@@ -0,0 +1,163 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package plotter
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// backpressureInterval is how often the free space on the plotter paths
+	// is checked.
+	backpressureInterval = 10 * time.Second
+)
+
+// backpressure watches the free space on the plotter paths and throttles the
+// plotting software when they are filling up faster than plots can be sent,
+// such as when the harvesters are full or offline.
+type backpressure struct {
+	queue  chan string
+	paused bool
+	done   chan struct{}
+}
+
+// newBackpressure creates the backpressure for the queue of plots to send.
+func newBackpressure(queue chan string) *backpressure {
+	return &backpressure{
+		queue: queue,
+		done:  make(chan struct{}),
+	}
+}
+
+// Run periodically checks the plotter paths, pausing the plotting software
+// when any of them drop below the pause watermark. It is resumed once all of
+// them are back above the resume watermark, or the queue of plots has drained
+// and they are above the pause watermark. When the context is done, plotting
+// is resumed so it isn't left paused once the plotter exits, and Done is
+// closed.
+func (b *backpressure) Run(ctx context.Context) {
+	defer close(b.done)
+
+	ticker := time.NewTicker(backpressureInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if b.paused {
+				log.Print("Resuming plotting before exiting")
+				b.paused = false
+				b.resume()
+			}
+			return
+		case <-ticker.C:
+			b.check()
+		}
+	}
+}
+
+// Done returns a channel which is closed once Run has returned.
+func (b *backpressure) Done() <-chan struct{} {
+	return b.done
+}
+
+// check compares the free space on the plotter paths to the watermarks.
+func (b *backpressure) check() {
+	lowest := uint64(100)
+	for _, path := range plotterPaths {
+		if free, ok := freePercent(path); ok {
+			lowest = min(lowest, free)
+		}
+	}
+
+	switch {
+	case !b.paused && lowest < uint64(pauseBelow):
+		log.Printf("Plotter disk is %d%% free, pausing plotting", lowest)
+		b.paused = true
+		b.pause()
+
+	case b.paused && (lowest >= uint64(resumeAbove) || b.drained() && lowest >= uint64(pauseBelow)):
+		log.Printf("Plotter disk is %d%% free, resuming plotting", lowest)
+		b.paused = false
+		b.resume()
+	}
+}
+
+// drained returns whether there are no plots waiting to be sent.
+func (b *backpressure) drained() bool {
+	return len(b.queue) == 0 && inflight.Load() == 0
+}
+
+// pause performs each of the configured actions to stop the plotting software.
+func (b *backpressure) pause() {
+	if pauseCommand != "" {
+		runCommand(pauseCommand)
+	}
+	if pauseFile != "" {
+		f, err := os.Create(pauseFile)
+		if err != nil {
+			log.Printf("Failed to create pause file %s: %v", pauseFile, err)
+		} else {
+			f.Close()
+		}
+	}
+	if pausePid > 0 {
+		signalPlotter(syscall.SIGSTOP)
+	}
+}
+
+// resume performs each of the configured actions to start the plotting
+// software back up.
+func (b *backpressure) resume() {
+	if resumeCommand != "" {
+		runCommand(resumeCommand)
+	}
+	if pauseFile != "" {
+		if err := os.Remove(pauseFile); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove pause file %s: %v", pauseFile, err)
+		}
+	}
+	if pausePid > 0 {
+		signalPlotter(syscall.SIGCONT)
+	}
+}
+
+// runCommand runs the command with the shell, logging any failure.
+func runCommand(command string) {
+	out, err := exec.Command("/bin/sh", "-c", command).CombinedOutput()
+	if err != nil {
+		log.Printf("Command %q failed: %v: %s", command, err, out)
+	}
+}
+
+// signalPlotter sends the signal to the configured plotting software process.
+func signalPlotter(sig syscall.Signal) {
+	if err := syscall.Kill(pausePid, sig); err != nil {
+		log.Printf("Failed to send %s to process %d: %v", sig.String(), pausePid, err)
+	}
+}
+
+// freePercent returns the percentage of free space on the disk the path is on.
+func freePercent(path string) (uint64, bool) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil || stat.Blocks == 0 {
+		return 0, false
+	}
+	return 100 * stat.Bavail / stat.Blocks, true
+}
+
+// freeBytes returns the space available on the disk the path is on.
+func freeBytes(path string) (uint64, bool) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, false
+	}
+	return stat.Bavail * uint64(stat.Bsize), true
+}
@@ -3,34 +3,89 @@
 package plotter
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	plotfile "github.com/krobertson/chia-garden/pkg/plot"
 	"github.com/krobertson/chia-garden/pkg/rpc"
+	"github.com/krobertson/chia-garden/pkg/transfer"
 	"github.com/krobertson/chia-garden/pkg/types"
 
 	"github.com/dustin/go-humanize"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// declineRetry is how long to wait before offering a plot again when the
+	// harvesters declined it only because they were busy.
+	declineRetry = 15 * time.Second
+
+	// locateConcurrency is how many plots are checked for at a time with
+	// harvesters which don't answer batched requests.
+	locateConcurrency = 16
 )
 
 var (
 	failedPlots     = []string{}
 	failedPlotMutex = sync.Mutex{}
+
+	// inflight is the number of plots currently being handled by workers.
+	inflight atomic.Int64
+
+	// slots limits how many plots are handled at once, shared between the
+	// workers and the overflow pass.
+	slots chan struct{}
+
+	// legacyHosts are the harvesters which have responded without support for
+	// batched locate requests, for those too old to send heartbeats.
+	legacyHosts sync.Map
+
+	// errParked is the cause used when a transfer is cancelled and the plot
+	// should be left in place rather than being requeued.
+	errParked = fmt.Errorf("%w and parked", transfer.ErrCancelled)
 )
 
-func plotworker(client *rpc.NatsPlotterClient, ch chan string) {
+// plotworker handles the plots from the queue until the context is done.
+func plotworker(ctx context.Context, client *rpc.NatsPlotterClient, ch chan string) {
 	for plot := range ch {
-		ok := handlePlot(client, plot)
-		if !ok {
+		if ctx.Err() != nil {
+			return
+		}
+		ok, handled := handleSlot(ctx, client, plot)
+		if !handled {
+			return
+		}
+		if !ok && ctx.Err() == nil {
 			// failed to send it, so requeue
 			ch <- plot
 		}
 	}
 }
 
+// handleSlot waits for a free slot and then handles the plot, counting it as in
+// flight. It returns whether the plot was sent, and false for handled if the
+// context was done before a slot was free.
+func handleSlot(ctx context.Context, client *rpc.NatsPlotterClient, plot string) (ok, handled bool) {
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return false, false
+	}
+	defer func() { <-slots }()
+
+	inflight.Add(1)
+	defer inflight.Add(-1)
+	return handlePlot(ctx, client, plot), true
+}
+
 // handlePlot will publish a message to find a location to send the plot. In
 // some failure cases, like not finding a host to send it to, it will sleep for
 // a minute and retry up to 10 times. The goal is that there may be transient
@@ -38,8 +93,13 @@ func plotworker(client *rpc.NatsPlotterClient, ch chan string) {
 // failure on the other server end, it will retry immediately. If it is able to
 // get the plot sent successfully, it will return true. If it is not, and it
 // times out in retries, it will return false so the caller can requeue the
-// plot.
-func handlePlot(client *rpc.NatsPlotterClient, plot string) bool {
+// plot. With replication, the plot is sent to different harvesters until the
+// configured number of them have it, and is only removed once they all do. If
+// no harvester has capacity for a plot which has been waiting too long, it is
+// moved to an overflow path and offered again later. Once the context is done,
+// it stops waiting on harvesters and returns false, though a transfer already
+// under way is left to finish.
+func handlePlot(ctx context.Context, client *rpc.NatsPlotterClient, plot string) bool {
 	// gather info
 	fi, err := os.Stat(plot)
 	if err != nil {
@@ -47,22 +107,117 @@ func handlePlot(client *rpc.NatsPlotterClient, plot string) bool {
 		return true
 	}
 	req := &types.PlotRequest{
-		Name: filepath.Base(plot),
-		Size: uint64(fi.Size()),
+		Name:       filepath.Base(plot),
+		Size:       uint64(fi.Size()),
+		Attributes: plotAttributes(plot),
 	}
 
-	for i := 0; i < 10; i++ {
-		resp, err := client.PlotReady(req)
+	// in pull mode, offer the plot for harvesters to download
+	var pending *pendingPull
+	if puller != nil {
+		pending = puller.offer(plot, fi.Size())
+		defer puller.remove(pending)
+		req.SourceUrl = pending.url
+	}
+
+	// find any harvesters which already have a replica
+	stored := locateReplicas(ctx, client, req)
+	if len(stored) >= replicas {
+		log.Printf("Plot %s already has %d replicas, cleaning up", plot, len(stored))
+		finishPlot(plot, int64(req.Size), true)
+		return true
+	}
+	var stalled []string
+
+	for i := 0; i < 10 && ctx.Err() == nil; i++ {
+		// skip harvesters which already have a replica or recently stalled
+		req.Exclude = append(slices.Clone(stored), stalled...)
+
+		resp, err := client.PlotReady(ctx, req)
+		if ctx.Err() != nil {
+			break
+		}
+		if errors.Is(err, nats.ErrNoResponders) {
+			// nobody is online to take it. overflow plots are offered again
+			// on the next pass, and others waiting too long are moved to an
+			// overflow path so the plotter disk doesn't fill
+			log.Printf("No harvesters responded to plot %s, waiting for them to come online", plot)
+			stalled = nil
+			if isOverflow(plot) {
+				return true
+			}
+			if canOverflow(plot, fi) && overflowPlot(plot, fi.Size()) {
+				return true
+			}
+
+			// waiting doesn't count as a retry, since it is all that can be
+			// done
+			i--
+			sleep(ctx, time.Minute)
+			continue
+		}
+		var declined *rpc.DeclinedError
+		if errors.As(err, &declined) {
+			log.Printf("Plot %s was %v", plot, declined)
+			stalled = nil
+
+			// overflow plots are offered again on the next pass. when the
+			// harvesters are only busy, retry soon, otherwise they are full
+			// so others waiting too long are moved to an overflow path
+			if isOverflow(plot) {
+				return true
+			}
+			if declined.Transient() {
+				sleep(ctx, declineRetry)
+				continue
+			}
+			if canOverflow(plot, fi) && overflowPlot(plot, fi.Size()) {
+				return true
+			}
+			sleep(ctx, time.Minute)
+			continue
+		}
+		if errors.Is(err, nats.ErrTimeout) {
+			// older harvesters without capacity don't respond
+			resp, err = nil, nil
+		}
 		if err != nil {
 			log.Print("Received error on plot ready request", err)
-			time.Sleep(time.Minute)
+			sleep(ctx, time.Minute)
 			continue
 		}
 
-		// if we did not get a response, sleep and try again
+		// if we did not get a response, sleep and try again. older
+		// harvesters don't decline, so they may be full or the bus may be
+		// down, which the heartbeats help tell apart
 		if resp == nil {
-			log.Print("Received no response")
-			time.Sleep(time.Minute)
+			log.Printf("Received no response for plot %s, %d harvesters are online", plot, members.Online())
+			stalled = nil
+
+			// overflow plots are offered again on the next pass, and others
+			// waiting too long are moved to an overflow path
+			if isOverflow(plot) {
+				return true
+			}
+			if canOverflow(plot, fi) && overflowPlot(plot, fi.Size()) {
+				return true
+			}
+
+			sleep(ctx, time.Minute)
+			continue
+		}
+
+		// remember harvesters which won't answer batched locate requests
+		if resp.Protocol.Has(types.CapLocateBatch) {
+			legacyHosts.Delete(resp.Protocol.Hostname)
+		} else {
+			legacyHosts.Store(resp.Protocol.Hostname, true)
+		}
+
+		// older harvesters don't know to skip themselves when excluded
+		if slices.Contains(req.Exclude, resp.Hostname) {
+			log.Printf("Harvester %s responded even though it was excluded, skipping it", resp.Hostname)
+			sleep(ctx, time.Minute)
 			continue
 		}
 
@@ -74,51 +229,277 @@ func handlePlot(client *rpc.NatsPlotterClient, plot string) bool {
 		}
 
 		// if we got a response, dispatch the transfer
-		httpreq, err := http.NewRequest("POST", resp.Url, f)
-		if err != nil {
-			log.Print("Failed to open http request", err)
+		start := time.Now()
+		last := len(stored) == replicas-1
+		status, err := transferPlot(context.WithoutCancel(ctx), client, plot, f, pending, resp, int64(req.Size), last)
+		if errors.Is(err, errParked) {
+			log.Printf("Transfer of plot %s was cancelled, parking it until restart", plot)
+			f.Close()
+			parkPlot(plot)
+			return true
+		}
+		if errors.Is(err, transfer.ErrCancelled) {
+			log.Printf("Transfer of plot %s was cancelled, requeuing it", plot)
+			f.Close()
+			return false
+		}
+		if errors.Is(err, transfer.ErrStalled) {
+			log.Printf("Transfer of plot %s to %s stalled, rescheduling elsewhere: %v", plot, resp.Hostname, err)
 			f.Close()
-			time.Sleep(time.Minute)
+			stalled = append(stalled, resp.Hostname)
 			continue
 		}
-		httpreq.ContentLength = int64(req.Size)
-
-		start := time.Now()
-		log.Printf("Sending plot %s to %s:%s", plot, resp.Hostname, resp.Store)
-		httpresp, err := http.DefaultTransport.RoundTrip(httpreq)
 		if err != nil {
-			log.Print("HTTP transfer failed", err)
+			log.Print("Transfer failed", err)
 			f.Close()
-			time.Sleep(time.Minute)
+			sleep(ctx, time.Minute)
 			continue
 		}
 
-		switch httpresp.StatusCode {
+		switch status {
 		case 201: // success
 			f.Close()
 			seconds := time.Since(start).Seconds()
 			log.Printf("Finished transfering plot %s (%s, %f secs, %s/sec)",
 				plot, humanize.IBytes(uint64(req.Size)), seconds, humanize.Bytes(uint64(float64(req.Size)/seconds)))
-			os.Remove(plot)
+
+			// send the next replica, resetting the retries for it
+			stored = append(stored, resp.Hostname)
+			if len(stored) < replicas {
+				log.Printf("Stored replica %d of %d of plot %s on %s", len(stored), replicas, plot, resp.Hostname)
+				i = -1
+				continue
+			}
+
+			finishPlot(plot, int64(req.Size), false)
 			return true
 
+		case 408: // harvester aborted a stalled transfer, try another host
+			log.Printf("Transfer of plot %s to %s stalled, rescheduling elsewhere", plot, resp.Hostname)
+			f.Close()
+			stalled = append(stalled, resp.Hostname)
+			continue
+
 		case 500: // transfer failure due to server error, wait a minute and retry
-			log.Print("Received 500 status code from server. Sleep and retry.", httpresp.Status)
+			log.Print("Received 500 status code from server. Sleep and retry.")
 			f.Close()
-			time.Sleep(time.Minute)
+			sleep(ctx, time.Minute)
 			continue
 
 		default: // other failures should immediately retry
-			log.Printf("Received %d status code from server, retry ready request immediately.", httpresp.StatusCode)
+			log.Printf("Received %d status code from server, retry ready request immediately.", status)
 			f.Close()
 			continue
 		}
 	}
 
+	if ctx.Err() != nil {
+		return false
+	}
+
 	// Too many retries, log and continue
 	log.Printf("Timed out transferring plot file %s, will retry later or on next restart", plot)
+	parkPlot(plot)
+	return false
+}
+
+// locateReplicas returns the hostnames of the harvesters which already have
+// the plot when replication is enabled.
+func locateReplicas(ctx context.Context, client *rpc.NatsPlotterClient, req *types.PlotRequest) []string {
+	if replicas <= 1 {
+		return nil
+	}
+
+	responses, err := client.PlotLocateAll(ctx, &types.PlotLocateRequest{
+		Name: req.Name,
+		Size: req.Size,
+	}, 2*time.Second)
+	if err != nil {
+		log.Printf("Failed to locate replicas of plot %s: %v", req.Name, err)
+	}
+
+	hosts := make([]string, 0, len(responses))
+	for _, resp := range responses {
+		if !slices.Contains(hosts, resp.Hostname) {
+			hosts = append(hosts, resp.Hostname)
+		}
+	}
+	return hosts
+}
+
+// sleep waits for the duration, or until the context is done.
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+}
+
+// locatePlots checks which of the plots the harvesters already have with a
+// batched request, rather than waiting on a request for each, and then checks
+// for any not found individually with older harvesters. It returns the
+// hostnames which have each plot and the plots a harvester has with a different
+// size, both keyed by the plot's path.
+func locatePlots(ctx context.Context, client *rpc.NatsPlotterClient, sizes map[string]int64) (map[string][]string, map[string]bool, error) {
+	paths := make(map[string][]string, len(sizes))
+	reqs := make([]*types.PlotLocateRequest, 0, len(sizes))
+	for path, size := range sizes {
+		name := filepath.Base(path)
+		if _, exists := paths[name]; !exists {
+			reqs = append(reqs, &types.PlotLocateRequest{Name: name, Size: uint64(size)})
+		}
+		paths[name] = append(paths[name], path)
+	}
+
+	responses, err := client.PlotLocateBatch(ctx, reqs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	located := make(map[string][]string)
+	mismatched := make(map[string]bool)
+	found := make(map[string]bool)
+	for _, resp := range responses {
+		for _, name := range resp.Found {
+			found[name] = true
+			for _, path := range paths[name] {
+				if !slices.Contains(located[path], resp.Hostname) {
+					located[path] = append(located[path], resp.Hostname)
+				}
+			}
+		}
+		for _, name := range resp.Mismatched {
+			found[name] = true
+			for _, path := range paths[name] {
+				mismatched[path] = true
+			}
+		}
+	}
+
+	// harvesters which predate batched requests don't answer them, so when
+	// any are known, the plots none of the others have are checked for one at
+	// a time
+	if !hasLegacyHarvesters() {
+		return located, mismatched, nil
+	}
+	missing := make([]*types.PlotLocateRequest, 0)
+	for _, req := range reqs {
+		if !found[req.Name] {
+			missing = append(missing, req)
+		}
+	}
+	for name, host := range locateEach(ctx, client, missing) {
+		for _, path := range paths[name] {
+			if host == "" {
+				mismatched[path] = true
+			} else {
+				located[path] = append(located[path], host)
+			}
+		}
+	}
+	return located, mismatched, nil
+}
+
+// hasLegacyHarvesters returns whether any of the harvesters online, or any
+// which have responded without sending heartbeats, don't support batched
+// locate requests.
+func hasLegacyHarvesters() bool {
+	supported := make(map[string]bool)
+	for _, member := range members.List() {
+		supported[member.Hostname] = member.Protocol.Has(types.CapLocateBatch)
+		if !member.Silent && !supported[member.Hostname] {
+			return true
+		}
+	}
+
+	// a harvester sending heartbeats with support has since been upgraded
+	legacy := false
+	legacyHosts.Range(func(host, _ any) bool {
+		legacy = !supported[host.(string)]
+		return !legacy
+	})
+	return legacy
+}
+
+// locateEach checks for each of the plots with a separate request, up to
+// locateConcurrency at a time. It returns the hostname of a harvester which has
+// each plot found, or an empty hostname when a harvester only has it with a
+// different size, keyed by the plot's name.
+func locateEach(ctx context.Context, client *rpc.NatsPlotterClient, reqs []*types.PlotLocateRequest) map[string]string {
+	results := make(map[string]string)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var offline atomic.Bool
+
+	sem := make(chan struct{}, locateConcurrency)
+	for _, req := range reqs {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(req *types.PlotLocateRequest) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			// once no harvesters are found at all, don't wait on the rest
+			if offline.Load() || ctx.Err() != nil {
+				return
+			}
+
+			resp, err := client.PlotLocate(ctx, req)
+			var terr *types.TransferError
+			switch {
+			case err == nil:
+				mutex.Lock()
+				results[req.Name] = resp.Hostname
+				mutex.Unlock()
+			case errors.As(err, &terr) && terr.Reason == types.ReasonSizeMismatch:
+				mutex.Lock()
+				results[req.Name] = ""
+				mutex.Unlock()
+			case errors.Is(err, nats.ErrNoResponders):
+				offline.Store(true)
+			}
+		}(req)
+	}
+	wg.Wait()
+	return results
+}
+
+// plotAttributes returns the attributes harvesters use to route the plot,
+// including which plotter it came from.
+func plotAttributes(path string) map[string]string {
+	attrs := plotfile.Attributes(path)
+	attrs[plotfile.AttrPlotter] = systemHostname
+	return attrs
+}
+
+// parkPlot records a plot which could not be sent. It is left in place, so it
+// will be picked up again when the plotter restarts.
+func parkPlot(plot string) {
 	failedPlotMutex.Lock()
 	failedPlots = append(failedPlots, plot)
 	failedPlotMutex.Unlock()
-	return false
+}
+
+// cancelTransfer is sent by an operator to abort any transfers of the plot.
+// Depending on the request, the plot is either requeued or parked once the
+// transfer has stopped.
+func cancelTransfer(req *types.TransferCancelRequest) *types.TransferCancelResponse {
+	cause := fmt.Errorf("%w by request", transfer.ErrCancelled)
+	if req.Park {
+		cause = errParked
+	}
+
+	n := tracker.Cancel(req.Name, cause)
+	if n == 0 {
+		return nil
+	}
+
+	log.Printf("Cancelled %d transfers of plot %s", n, req.Name)
+	return &types.TransferCancelResponse{
+		Hostname:  systemHostname,
+		Role:      "plotter",
+		Cancelled: n,
+	}
 }
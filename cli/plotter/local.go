@@ -0,0 +1,55 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package plotter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/krobertson/chia-garden/pkg/rpc"
+	"github.com/krobertson/chia-garden/pkg/types"
+	"github.com/krobertson/chia-garden/pkg/utils"
+)
+
+const (
+	// localMoveRate is the minimum rate a local copy is expected to progress
+	// at, used to determine how long to wait for the harvester.
+	localMoveRate = 50 << 20
+)
+
+var (
+	systemHostname, _ = os.Hostname()
+	systemMachineId   = utils.GetMachineID()
+)
+
+// isLocal returns whether the harvester which responded is running on the same
+// machine as the plotter. Hostnames aren't always unique, and harvesters only
+// move plots for a plotter with their machine ID, so both sides must have one.
+func isLocal(resp *types.PlotResponse) bool {
+	return resp.MachineId != "" && systemMachineId != "" && resp.MachineId == systemMachineId
+}
+
+// movePlot asks the local harvester to move the plot directly into its store.
+// An error is returned if the harvester was unable to access the plot, in which
+// case it should be sent normally instead.
+func movePlot(ctx context.Context, client *rpc.NatsPlotterClient, plot string, resp *types.PlotResponse, size uint64) (int, error) {
+	abs, err := filepath.Abs(plot)
+	if err != nil {
+		return 0, err
+	}
+
+	timeout := time.Minute + time.Duration(size/localMoveRate)*time.Second
+	moveResp, err := client.PlotMove(ctx, resp.Hostname, &types.PlotMoveRequest{
+		Name:      filepath.Base(plot),
+		Size:      size,
+		Store:     resp.Store,
+		Source:    abs,
+		MachineId: systemMachineId,
+	}, timeout)
+	if err != nil {
+		return 0, err
+	}
+	return moveResp.Status, nil
+}
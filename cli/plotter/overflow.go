@@ -0,0 +1,129 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package plotter
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/krobertson/chia-garden/pkg/rpc"
+)
+
+const (
+	// overflowInterval is how often plots in the overflow paths are offered
+	// to the harvesters again.
+	overflowInterval = 5 * time.Minute
+)
+
+// isOverflow returns whether the plot is in one of the overflow paths.
+func isOverflow(plot string) bool {
+	return slices.Contains(overflowPaths, filepath.Dir(plot))
+}
+
+// canOverflow returns whether a plot no harvester has capacity for should be
+// moved to an overflow path. Plots are only moved once they have been waiting
+// to be sent for longer than the overflow delay.
+func canOverflow(plot string, fi os.FileInfo) bool {
+	return len(overflowPaths) > 0 && !isOverflow(plot) && time.Since(fi.ModTime()) >= overflowAfter
+}
+
+// overflowPlot moves the plot to the overflow path with the most free space,
+// freeing up the plotter path while the harvesters are full. It returns false
+// if none of the overflow paths can hold it, in which case it is left in place.
+func overflowPlot(plot string, size int64) bool {
+	var best string
+	var bestFree uint64
+	for _, path := range overflowPaths {
+		free, ok := freeBytes(path)
+		if !ok || free < uint64(size) || free <= bestFree {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(path, filepath.Base(plot))); err == nil {
+			continue
+		}
+		best, bestFree = path, free
+	}
+	if best == "" {
+		log.Printf("No overflow path has space for plot %s, leaving it in place", plot)
+		return false
+	}
+
+	dest := filepath.Join(best, filepath.Base(plot))
+	if err := moveFile(plot, dest); err != nil {
+		log.Printf("Failed to move plot %s to overflow path %s: %v", plot, best, err)
+		return false
+	}
+	log.Printf("No harvester has capacity for plot %s, moved it to overflow path %s", plot, best)
+	return true
+}
+
+// runOverflow periodically offers the plots in the overflow paths to the
+// harvesters again, one at a time, so they are sent once capacity appears. It
+// returns once the context is done.
+func runOverflow(ctx context.Context, client *rpc.NatsPlotterClient) {
+	for ctx.Err() == nil {
+		var plots []string
+		sizes := make(map[string]int64)
+		for _, path := range overflowPaths {
+			files, err := os.ReadDir(path)
+			if err != nil {
+				log.Printf("Failed to list files for overflow path %s: %v", path, err)
+				continue
+			}
+			for _, de := range files {
+				if filepath.Ext(de.Name()) != "."+plotSuffix {
+					continue
+				}
+				plot := filepath.Join(path, de.Name())
+				if retained.has(plot) {
+					continue
+				}
+				fi, err := de.Info()
+				if err != nil {
+					continue
+				}
+				plots = append(plots, plot)
+				sizes[plot] = fi.Size()
+			}
+		}
+
+		// check which have already been stored, such as when the plotter was
+		// restarted before removing them. with replication, handlePlot checks
+		// for each replica itself
+		var located map[string][]string
+		if replicas <= 1 && len(sizes) > 0 {
+			var err error
+			located, _, err = locatePlots(ctx, client, sizes)
+			if err != nil {
+				log.Printf("Failed to locate overflow plots, trying again later: %v", err)
+				sleep(ctx, overflowInterval)
+				continue
+			}
+		}
+
+		for _, plot := range plots {
+			if ctx.Err() != nil {
+				return
+			}
+			offerOverflow(ctx, client, plot, sizes[plot], located[plot])
+		}
+		sleep(ctx, overflowInterval)
+	}
+}
+
+// offerOverflow cleans up an overflow plot the harvesters already have, and
+// otherwise tries to send it, taking one of the transfer slots the same as the
+// workers. If no harvester has capacity, it is left for the next pass.
+func offerOverflow(ctx context.Context, client *rpc.NatsPlotterClient, plot string, size int64, hosts []string) {
+	if len(hosts) > 0 {
+		log.Printf("Overflow plot %s already exists, cleaning up", plot)
+		finishPlot(plot, size, true)
+		return
+	}
+
+	handleSlot(ctx, client, plot)
+}
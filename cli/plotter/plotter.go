@@ -3,17 +3,22 @@
 package plotter
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/krobertson/chia-garden/cli"
 	"github.com/krobertson/chia-garden/pkg/rpc"
+	"github.com/krobertson/chia-garden/pkg/transfer"
 	"github.com/krobertson/chia-garden/pkg/types"
 
 	"github.com/fsnotify/fsnotify"
-	"github.com/nats-io/nats.go"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -28,9 +33,39 @@ plotter nodes and to find and transport them to a harvester for use.`,
 		Run: cmdPlotter,
 	}
 
-	plotterPaths []string
-	maxTransfers int
-	plotSuffix   string
+	plotterPaths     []string
+	maxTransfers     int
+	plotSuffix       string
+	ioMode           string
+	streams          int
+	pullUrl          string
+	pullPort         int
+	transport        string
+	localMove        bool
+	progressInterval time.Duration
+	stallTimeout     time.Duration
+	commitTimeout    time.Duration
+	sentMode         string
+	archiveDir       string
+	retainAge        time.Duration
+	retainMinFree    int
+	replicas         int
+	pauseBelow       int
+	resumeAbove      int
+	pauseCommand     string
+	resumeCommand    string
+	pauseFile        string
+	pausePid         int
+	overflowPaths    []string
+	overflowAfter    time.Duration
+	readyTimeout     time.Duration
+	locateTimeout    time.Duration
+	requestTimeout   time.Duration
+
+	puller   *pullServer
+	retained *retainer
+	members  *rpc.Membership
+	tracker  = transfer.NewTracker(systemHostname, "plotter")
 )
 
 func init() {
@@ -38,34 +73,245 @@ func init() {
 
 	viper.SetDefault("plotter.max_transfers", 2)
 	viper.SetDefault("plotter.suffix", "plot")
+	viper.SetDefault("plotter.io_mode", ioModeBuffered)
+	viper.SetDefault("plotter.streams", 1)
+	viper.SetDefault("plotter.pull_url", "")
+	viper.SetDefault("plotter.pull_port", 3435)
+	viper.SetDefault("plotter.transport", transportHTTP)
+	viper.SetDefault("plotter.local_move", true)
+	viper.SetDefault("plotter.progress_interval", 30*time.Second)
+	viper.SetDefault("plotter.stall_timeout", 2*time.Minute)
+	viper.SetDefault("plotter.commit_timeout", 10*time.Minute)
+	viper.SetDefault("plotter.sent_mode", sentModeDelete)
+	viper.SetDefault("plotter.archive_dir", "")
+	viper.SetDefault("plotter.retain_age", time.Duration(0))
+	viper.SetDefault("plotter.retain_min_free", 0)
+	viper.SetDefault("plotter.replicas", 1)
+	viper.SetDefault("plotter.pause_below", 0)
+	viper.SetDefault("plotter.resume_above", 0)
+	viper.SetDefault("plotter.pause_command", "")
+	viper.SetDefault("plotter.resume_command", "")
+	viper.SetDefault("plotter.pause_file", "")
+	viper.SetDefault("plotter.pause_pid", 0)
+	viper.SetDefault("plotter.overflow_paths", []string{})
+	viper.SetDefault("plotter.overflow_after", 30*time.Minute)
+	viper.SetDefault("plotter.ready_timeout", rpc.DefaultTimeouts.Ready)
+	viper.SetDefault("plotter.locate_timeout", rpc.DefaultTimeouts.Locate)
+	viper.SetDefault("plotter.request_timeout", rpc.DefaultTimeouts.Request)
 
 	viper.BindEnv("plotter.max_transfers")
 	viper.BindEnv("plotter.suffix")
+	viper.BindEnv("plotter.io_mode")
+	viper.BindEnv("plotter.streams")
+	viper.BindEnv("plotter.pull_url")
+	viper.BindEnv("plotter.pull_port")
+	viper.BindEnv("plotter.transport")
+	viper.BindEnv("plotter.local_move")
+	viper.BindEnv("plotter.progress_interval")
+	viper.BindEnv("plotter.stall_timeout")
+	viper.BindEnv("plotter.commit_timeout")
+	viper.BindEnv("plotter.sent_mode")
+	viper.BindEnv("plotter.archive_dir")
+	viper.BindEnv("plotter.retain_age")
+	viper.BindEnv("plotter.retain_min_free")
+	viper.BindEnv("plotter.replicas")
+	viper.BindEnv("plotter.pause_below")
+	viper.BindEnv("plotter.resume_above")
+	viper.BindEnv("plotter.pause_command")
+	viper.BindEnv("plotter.resume_command")
+	viper.BindEnv("plotter.pause_file")
+	viper.BindEnv("plotter.pause_pid")
+	viper.BindEnv("plotter.overflow_paths")
+	viper.BindEnv("plotter.overflow_after")
+	viper.BindEnv("plotter.ready_timeout")
+	viper.BindEnv("plotter.locate_timeout")
+	viper.BindEnv("plotter.request_timeout")
 
 	PlotterCmd.Flags().StringSliceVarP(&plotterPaths, "path", "p", nil, "Paths to watch for plots")
 	PlotterCmd.Flags().IntVarP(&maxTransfers, "max-transfers", "t", viper.GetInt("plotter.max_transfers"), "Max concurrent transfers")
 	PlotterCmd.Flags().StringVarP(&plotSuffix, "suffix", "s", viper.GetString("plotter.suffix"), "The suffix or extension of plot files")
+	PlotterCmd.Flags().StringVarP(&ioMode, "io-mode", "", viper.GetString("plotter.io_mode"), "How plots are read from disk (buffered, fadvise)")
+	PlotterCmd.Flags().IntVarP(&streams, "streams", "", viper.GetInt("plotter.streams"), "Number of parallel connections to use for each plot transfer")
+	PlotterCmd.Flags().StringVarP(&pullUrl, "pull-url", "", viper.GetString("plotter.pull_url"), "Base URL harvesters can reach this plotter at, enables pull mode")
+	PlotterCmd.Flags().IntVarP(&pullPort, "pull-port", "", viper.GetInt("plotter.pull_port"), "Port to serve plots on in pull mode")
+	PlotterCmd.Flags().StringVarP(&transport, "transport", "", viper.GetString("plotter.transport"), "How to send plots to harvesters (http, nats, auto)")
+	PlotterCmd.Flags().BoolVarP(&localMove, "local-move", "", viper.GetBool("plotter.local_move"), "Move plots directly when the harvester is on the same machine")
+	PlotterCmd.Flags().DurationVarP(&progressInterval, "progress-interval", "", viper.GetDuration("plotter.progress_interval"), "How often to log and publish transfer progress")
+	PlotterCmd.Flags().DurationVarP(&stallTimeout, "stall-timeout", "", viper.GetDuration("plotter.stall_timeout"), "Abort transfers which send no data for this long")
+	PlotterCmd.Flags().DurationVarP(&commitTimeout, "commit-timeout", "", viper.GetDuration("plotter.commit_timeout"), "How long to wait for the harvester to store a plot once it is sent")
+	PlotterCmd.Flags().StringVarP(&sentMode, "sent-mode", "", viper.GetString("plotter.sent_mode"), "What to do with plots once sent (delete, keep, archive)")
+	PlotterCmd.Flags().StringVarP(&archiveDir, "archive-dir", "", viper.GetString("plotter.archive_dir"), "Directory to move sent plots to in archive mode")
+	PlotterCmd.Flags().DurationVarP(&retainAge, "retain-age", "", viper.GetDuration("plotter.retain_age"), "How long to keep sent plots after a harvester confirms it has them")
+	PlotterCmd.Flags().IntVarP(&retainMinFree, "retain-min-free", "", viper.GetInt("plotter.retain_min_free"), "Remove the oldest kept plots early when a disk has less than this percent free")
+	PlotterCmd.Flags().IntVarP(&replicas, "replicas", "", viper.GetInt("plotter.replicas"), "Number of harvesters to store each plot on")
+	PlotterCmd.Flags().IntVarP(&pauseBelow, "pause-below", "", viper.GetInt("plotter.pause_below"), "Pause plotting when a plotter path has less than this percent free")
+	PlotterCmd.Flags().IntVarP(&resumeAbove, "resume-above", "", viper.GetInt("plotter.resume_above"), "Resume plotting once all plotter paths have at least this percent free")
+	PlotterCmd.Flags().StringVarP(&pauseCommand, "pause-command", "", viper.GetString("plotter.pause_command"), "Command to run to pause plotting")
+	PlotterCmd.Flags().StringVarP(&resumeCommand, "resume-command", "", viper.GetString("plotter.resume_command"), "Command to run to resume plotting")
+	PlotterCmd.Flags().StringVarP(&pauseFile, "pause-file", "", viper.GetString("plotter.pause_file"), "File to create while plotting is paused")
+	PlotterCmd.Flags().IntVarP(&pausePid, "pause-pid", "", viper.GetInt("plotter.pause_pid"), "Process to stop while plotting is paused")
+	PlotterCmd.Flags().StringSliceVarP(&overflowPaths, "overflow-path", "", viper.GetStringSlice("plotter.overflow_paths"), "Local paths to move plots to when no harvester has capacity")
+	PlotterCmd.Flags().DurationVarP(&overflowAfter, "overflow-after", "", viper.GetDuration("plotter.overflow_after"), "How long a plot waits to be sent before it can be moved to an overflow path")
+	PlotterCmd.Flags().DurationVarP(&readyTimeout, "ready-timeout", "", viper.GetDuration("plotter.ready_timeout"), "How long to wait for harvesters to respond to a new plot")
+	PlotterCmd.Flags().DurationVarP(&locateTimeout, "locate-timeout", "", viper.GetDuration("plotter.locate_timeout"), "How long to wait for a harvester which has a plot")
+	PlotterCmd.Flags().DurationVarP(&requestTimeout, "request-timeout", "", viper.GetDuration("plotter.request_timeout"), "How long to wait for a harvester to respond to other requests")
 
 	viper.BindPFlag("plotter.max_transfers", PlotterCmd.Flags().Lookup("max-transfers"))
 	viper.BindPFlag("plotter.suffix", PlotterCmd.Flags().Lookup("suffix"))
+	viper.BindPFlag("plotter.io_mode", PlotterCmd.Flags().Lookup("io-mode"))
+	viper.BindPFlag("plotter.streams", PlotterCmd.Flags().Lookup("streams"))
+	viper.BindPFlag("plotter.pull_url", PlotterCmd.Flags().Lookup("pull-url"))
+	viper.BindPFlag("plotter.pull_port", PlotterCmd.Flags().Lookup("pull-port"))
+	viper.BindPFlag("plotter.transport", PlotterCmd.Flags().Lookup("transport"))
+	viper.BindPFlag("plotter.local_move", PlotterCmd.Flags().Lookup("local-move"))
+	viper.BindPFlag("plotter.progress_interval", PlotterCmd.Flags().Lookup("progress-interval"))
+	viper.BindPFlag("plotter.stall_timeout", PlotterCmd.Flags().Lookup("stall-timeout"))
+	viper.BindPFlag("plotter.commit_timeout", PlotterCmd.Flags().Lookup("commit-timeout"))
+	viper.BindPFlag("plotter.sent_mode", PlotterCmd.Flags().Lookup("sent-mode"))
+	viper.BindPFlag("plotter.archive_dir", PlotterCmd.Flags().Lookup("archive-dir"))
+	viper.BindPFlag("plotter.retain_age", PlotterCmd.Flags().Lookup("retain-age"))
+	viper.BindPFlag("plotter.retain_min_free", PlotterCmd.Flags().Lookup("retain-min-free"))
+	viper.BindPFlag("plotter.replicas", PlotterCmd.Flags().Lookup("replicas"))
+	viper.BindPFlag("plotter.pause_below", PlotterCmd.Flags().Lookup("pause-below"))
+	viper.BindPFlag("plotter.resume_above", PlotterCmd.Flags().Lookup("resume-above"))
+	viper.BindPFlag("plotter.pause_command", PlotterCmd.Flags().Lookup("pause-command"))
+	viper.BindPFlag("plotter.resume_command", PlotterCmd.Flags().Lookup("resume-command"))
+	viper.BindPFlag("plotter.pause_file", PlotterCmd.Flags().Lookup("pause-file"))
+	viper.BindPFlag("plotter.pause_pid", PlotterCmd.Flags().Lookup("pause-pid"))
+	viper.BindPFlag("plotter.overflow_paths", PlotterCmd.Flags().Lookup("overflow-path"))
+	viper.BindPFlag("plotter.overflow_after", PlotterCmd.Flags().Lookup("overflow-after"))
+	viper.BindPFlag("plotter.ready_timeout", PlotterCmd.Flags().Lookup("ready-timeout"))
+	viper.BindPFlag("plotter.locate_timeout", PlotterCmd.Flags().Lookup("locate-timeout"))
+	viper.BindPFlag("plotter.request_timeout", PlotterCmd.Flags().Lookup("request-timeout"))
 }
 
 func cmdPlotter(cmd *cobra.Command, args []string) {
 	log.Printf("GOMAXPROCS set to %d", runtime.GOMAXPROCS(0))
 	log.Print("Starting plotter-client...")
 
+	// validate the io mode and transport
+	if ioMode != ioModeBuffered && ioMode != ioModeFadvise {
+		log.Fatalf("Invalid io mode %q, must be one of buffered or fadvise", ioMode)
+	}
+	switch transport {
+	case transportHTTP, transportNats, transportAuto:
+	default:
+		log.Fatalf("Invalid transport %q, must be one of http, nats, or auto", transport)
+	}
+	switch sentMode {
+	case sentModeDelete, sentModeKeep:
+	case sentModeArchive:
+		if archiveDir == "" {
+			log.Fatal("An archive directory must be specified in archive mode")
+		}
+	default:
+		log.Fatalf("Invalid sent mode %q, must be one of delete, keep, or archive", sentMode)
+	}
+	if replicas < 1 {
+		log.Fatalf("Invalid replicas %d, must be at least 1", replicas)
+	}
+	if stallTimeout <= 0 {
+		log.Fatalf("Invalid stall timeout %s, must be greater than 0", stallTimeout.String())
+	}
+	if commitTimeout <= 0 {
+		log.Fatalf("Invalid commit timeout %s, must be greater than 0", commitTimeout.String())
+	}
+	if pauseBelow < 0 || pauseBelow > 100 {
+		log.Fatalf("Invalid pause watermark %d, must be between 0 and 100", pauseBelow)
+	}
+	if resumeAbove < 0 || resumeAbove > 100 {
+		log.Fatalf("Invalid resume watermark %d, must be between 0 and 100", resumeAbove)
+	}
+	if resumeAbove < pauseBelow {
+		resumeAbove = pauseBelow
+	}
+	for i, path := range overflowPaths {
+		overflowPaths[i] = filepath.Clean(path)
+		if err := os.MkdirAll(overflowPaths[i], 0755); err != nil {
+			log.Fatalf("Failed to create overflow path %s: %v", path, err)
+		}
+	}
+
 	// connect to nats
-	conn, err := nats.Connect(cli.NatsUrl, nats.MaxReconnects(-1))
+	conn, err := cli.Connect("chia-garden plotter")
 	if err != nil {
 		log.Fatal("Failed to connect to NATS: ", err)
 	}
 	defer conn.Close()
 
-	// initialize client and create fixed worker routines
-	client := rpc.NewNatsPlotterClient(conn)
+	// start serving plots if harvesters will be pulling them
+	if pullUrl != "" {
+		puller, err = newPullServer(pullUrl, pullPort)
+		if err != nil {
+			log.Fatal("Failed to initialize pull server: ", err)
+		}
+	}
+
+	// periodically report on active transfers
+	go tracker.Run(progressInterval, func(p *types.TransferProgress) {
+		rpc.PublishTransferProgress(conn, p)
+	})
+
+	// allow transfers to be cancelled on demand
+	_, err = rpc.SubscribeTransferCancel(conn, cancelTransfer)
+	if err != nil {
+		log.Fatal("Failed to subscribe to cancel requests: ", err)
+	}
+
+	// stop offering plots on TERM, leaving the transfers under way to finish
+	ctx, cancel := context.WithCancel(context.Background())
+	sigint := make(chan os.Signal, 1)
+	signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigint
+		log.Print("Shutting down, waiting for active transfers to finish...")
+		cancel()
+	}()
+
+	// track which harvesters are online from their heartbeats
+	members, err = rpc.WatchMembership(conn, true)
+	if err != nil {
+		log.Fatal("Failed to watch harvester heartbeats: ", err)
+	}
+	if err := members.Refresh(ctx, time.Second); err != nil {
+		log.Printf("Failed to request harvester state: %v", err)
+	}
+	log.Printf("Found %d harvesters online", members.Online())
+
+	// initialize client
+	client := rpc.NewNatsPlotterClient(conn, rpc.Timeouts{
+		Ready:   readyTimeout,
+		Locate:  locateTimeout,
+		Request: requestTimeout,
+	})
+
+	// keep sent plots around until the retention policy removes them
+	if sentMode != sentModeDelete {
+		retained, err = newRetainer(client)
+		if err != nil {
+			log.Fatal("Failed to initialize retention: ", err)
+		}
+		go retained.Run(ctx)
+	}
+
 	plotqueue := make(chan string, 1024)
+	slots = make(chan struct{}, maxTransfers)
+
+	// throttle the plotting software if plots are piling up
+	var throttle *backpressure
+	if pauseBelow > 0 {
+		throttle = newBackpressure(plotqueue)
+		go throttle.Run(ctx)
+	}
+
+	// re-offer plots which were moved to the overflow paths
+	if len(overflowPaths) > 0 {
+		go runOverflow(ctx, client)
+	}
+
+	// create fixed worker routines
 	for i := 0; i < maxTransfers; i++ {
-		go plotworker(client, plotqueue)
+		go plotworker(ctx, client, plotqueue)
 	}
 
 	// begin watching the plots directory
@@ -124,6 +370,11 @@ func cmdPlotter(cmd *cobra.Command, args []string) {
 				continue
 			}
 
+			// skip plots kept after they were already sent
+			if retained.has(filepath.Join(path, name)) {
+				continue
+			}
+
 			existingFiles = append(existingFiles, filepath.Join(path, name))
 		}
 
@@ -135,7 +386,8 @@ func cmdPlotter(cmd *cobra.Command, args []string) {
 
 	log.Print("Ready")
 
-	// Loop and check the existing files for plots
+	// Check which of the existing plots the harvesters already have
+	sizes := make(map[string]int64, len(existingFiles))
 	for _, file := range existingFiles {
 		fi, err := os.Stat(file)
 		if err != nil {
@@ -143,35 +395,58 @@ func cmdPlotter(cmd *cobra.Command, args []string) {
 			os.Remove(file)
 			continue
 		}
+		sizes[file] = fi.Size()
+	}
+	located, mismatched, err := locatePlots(ctx, client, sizes)
+	if err != nil && len(sizes) > 0 {
+		log.Printf("Failed to locate existing plots, will retry on next restart: %v", err)
+		sizes = nil
+	}
 
-		// do request to see if any nodes have it
-		req := &types.PlotLocateRequest{
-			Name: filepath.Base(file),
-			Size: uint64(fi.Size()),
+	for _, file := range existingFiles {
+		size, exists := sizes[file]
+		if !exists {
+			continue
 		}
-		resp, err := client.PlotLocate(req)
+		hosts := located[file]
 
-		// if a valid resp and no error, it does exist, so remove and continue
-		if resp != nil && err == nil {
+		switch {
+		// if a harvester has it, remove it. with replication, queue it to
+		// check the rest of the replicas
+		case len(hosts) > 0 && replicas > 1:
+			log.Printf("Plot %s exists on %s, queuing to check replicas...", file, strings.Join(hosts, ", "))
+			plotqueue <- file
+		case len(hosts) > 0:
 			log.Printf("Plot %s already exists, cleaning up", file)
-			os.Remove(file)
-			continue
-		}
+			finishPlot(file, size, true)
+
+		// a harvester has a different copy, which may be partial or corrupt,
+		// so still send this one
+		case mismatched[file]:
+			log.Printf("Plot %s differs from the copy on a harvester, queuing to send...", file)
+			plotqueue <- file
 
-		// if resp is nil and err is a timeout error, it does not exist, send it
-		if resp == nil && err == nats.ErrTimeout {
+		// otherwise it does not exist, so send it. if no harvesters are
+		// online, it is sent once they are
+		default:
 			log.Printf("Plot %s not on harvesters, queuing to send...", file)
 			plotqueue <- file
-			continue
 		}
+	}
 
-		// other error, log and continue
-		if err != nil {
-			log.Printf("Other error from NATS locate request: %v", err)
-			continue
+	// Block main goroutine until shutdown, then wait for the workers to
+	// finish, unless signalled again. The plotting software is resumed first
+	// so it isn't left paused.
+	<-ctx.Done()
+	if throttle != nil {
+		<-throttle.Done()
+	}
+	for inflight.Load() > 0 {
+		select {
+		case <-sigint:
+			log.Print("Exiting without waiting for transfers")
+			return
+		case <-time.After(time.Second):
 		}
 	}
-
-	// Block main goroutine forever.
-	<-make(chan struct{})
 }
@@ -0,0 +1,213 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package plotter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krobertson/chia-garden/pkg/rpc"
+	"github.com/krobertson/chia-garden/pkg/transfer"
+	"github.com/krobertson/chia-garden/pkg/types"
+)
+
+const (
+	// pullUrlExpiration is how long a signed URL for a plot is valid.
+	pullUrlExpiration = 24 * time.Hour
+)
+
+// pullServer serves plots over HTTP for harvesters to download when the
+// plotter is in pull mode. Only plots currently being offered are served, and
+// only with a valid signed URL.
+type pullServer struct {
+	baseUrl string
+	signer  *transfer.Signer
+	pending map[string]*pendingPull
+	mutex   sync.Mutex
+}
+
+// pendingPull is a plot currently being offered to a harvester.
+type pendingPull struct {
+	path     string
+	size     int64
+	url      string
+	file     *os.File
+	progress *transfer.Progress
+	result   chan int
+}
+
+// newPullServer creates the pull server and begins listening on the specified
+// port.
+func newPullServer(baseUrl string, port int) (*pullServer, error) {
+	signer, err := transfer.NewSigner()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &pullServer{
+		baseUrl: strings.TrimSuffix(baseUrl, "/"),
+		signer:  signer,
+		pending: make(map[string]*pendingPull),
+	}
+
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           s,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil {
+			log.Fatal("Failed to start pull server: ", err)
+		}
+	}()
+	log.Printf("Serving plots at %s for pull transfers...", s.baseUrl)
+
+	return s, nil
+}
+
+// offer registers the plot to be served and returns the pending pull, which
+// includes the signed URL for it. remove must be called when finished.
+func (s *pullServer) offer(path string, size int64) *pendingPull {
+	name := filepath.Base(path)
+
+	p := &pendingPull{
+		path:   path,
+		size:   size,
+		result: make(chan int, 1),
+		url: fmt.Sprintf("%s/%s?%s",
+			s.baseUrl, url.PathEscape(name), s.signer.Query(name, pullUrlExpiration)),
+	}
+
+	s.mutex.Lock()
+	s.pending[name] = p
+	s.mutex.Unlock()
+	return p
+}
+
+// serve sets the file and progress for the plot being pulled. They're guarded
+// by the server's mutex, as the harvester may request the plot at any point
+// after it has been offered.
+func (s *pullServer) serve(p *pendingPull, f *os.File, progress *transfer.Progress) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p.file = f
+	p.progress = progress
+}
+
+// remove stops serving the plot.
+func (s *pullServer) remove(p *pendingPull) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name := filepath.Base(p.path)
+	if s.pending[name] == p {
+		delete(s.pending, name)
+	}
+}
+
+// ServeHTTP handles harvesters downloading the plot with a GET request, and
+// then reporting the result of storing it with a POST request.
+func (s *pullServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+
+	// validate the signature
+	name := strings.TrimPrefix(req.URL.Path, "/")
+	if !s.signer.Verify(name, req.URL.Query()) {
+		log.Printf("Rejecting pull request for %s with invalid signature", name)
+		w.WriteHeader(403)
+		return
+	}
+
+	s.mutex.Lock()
+	p := s.pending[name]
+	var f *os.File
+	var progress *transfer.Progress
+	if p != nil {
+		f, progress = p.file, p.progress
+	}
+	s.mutex.Unlock()
+	if p == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		// the plot isn't served until a harvester has been asked to pull it
+		if f == nil {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(p.size, 10))
+		w.WriteHeader(200)
+		_, err := io.Copy(w, sectionReader(f, 0, p.size, progress))
+		if err != nil {
+			log.Printf("Failure while serving plot %s: %v", p.path, err)
+		}
+
+	case http.MethodPost:
+		status, err := strconv.Atoi(req.Header.Get(transfer.HeaderPullResult))
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		select {
+		case p.result <- status:
+		default:
+		}
+		w.WriteHeader(204)
+
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+// wait blocks until the harvester reports the result of the pull, or the
+// context is cancelled due to the pull stalling.
+func (p *pendingPull) wait(ctx context.Context) (int, error) {
+	select {
+	case status := <-p.result:
+		return status, nil
+	case <-ctx.Done():
+		return 0, fmt.Errorf("pull by harvester aborted: %w", context.Cause(ctx))
+	}
+}
+
+// pullPlot asks the chosen harvester to pull the plot and then waits for it to
+// report the result. It returns the status code the harvester reported.
+func pullPlot(ctx context.Context, client *rpc.NatsPlotterClient, p *pendingPull, f *os.File, resp *types.PlotResponse, progress *transfer.Progress) (int, error) {
+	// reset the state from any prior attempt
+	select {
+	case <-p.result:
+	default:
+	}
+	puller.serve(p, f, progress)
+
+	// watch for the harvester to stop reading the plot or reporting the result
+	wctx, stop := transfer.Watch(progress, stallTimeout, commitTimeout)
+	defer stop()
+
+	_, err := client.PlotPull(ctx, resp.Hostname, &types.PlotPullRequest{
+		Name:      filepath.Base(p.path),
+		Size:      uint64(p.size),
+		Store:     resp.Store,
+		SourceUrl: p.url,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return p.wait(wctx)
+}
@@ -0,0 +1,375 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package plotter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/krobertson/chia-garden/pkg/rpc"
+)
+
+const (
+	// sentModeDelete removes plots as soon as the harvester has stored them.
+	sentModeDelete = "delete"
+
+	// sentModeKeep leaves sent plots in place until they are removed by the
+	// retention policy.
+	sentModeKeep = "keep"
+
+	// sentModeArchive moves sent plots into the archive directory until they
+	// are removed by the retention policy.
+	sentModeArchive = "archive"
+
+	// retainCheckInterval is how often retained plots are checked to see if
+	// they can be deleted.
+	retainCheckInterval = time.Minute
+
+	// retainStateFile is the file in each plotter path recording the plots
+	// kept there after being sent in keep mode, so they are told apart from
+	// plots waiting to be sent when the plotter restarts.
+	retainStateFile = ".chia-garden-retained.json"
+)
+
+// retainedPlot is a plot which has been sent, but is being kept on the
+// plotter.
+type retainedPlot struct {
+	path      string
+	size      int64
+	sent      time.Time
+	confirmed bool
+}
+
+// retainedState is how a kept plot is recorded in the state file.
+type retainedState struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Sent      time.Time `json:"sent"`
+	Confirmed bool      `json:"confirmed"`
+}
+
+// retainer keeps plots after they are sent until a harvester confirms it has
+// them, and then deletes them based on the retention policy.
+type retainer struct {
+	client *rpc.NatsPlotterClient
+	plots  []*retainedPlot
+	mutex  sync.Mutex
+}
+
+// newRetainer creates the retainer for the configured mode. In archive mode,
+// plots already in the archive directory are picked back up, and in keep mode,
+// the plots recorded in the state file of each plotter path.
+func newRetainer(client *rpc.NatsPlotterClient) (*retainer, error) {
+	r := &retainer{client: client}
+	if sentMode == sentModeKeep {
+		for _, path := range plotterPaths {
+			r.load(path)
+		}
+		return r, nil
+	}
+	if sentMode != sentModeArchive {
+		return r, nil
+	}
+
+	if err := os.MkdirAll(archiveDir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, de := range files {
+		if filepath.Ext(de.Name()) != "."+plotSuffix {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			continue
+		}
+		r.add(filepath.Join(archiveDir, de.Name()), fi.Size(), fi.ModTime(), false)
+	}
+	return r, nil
+}
+
+// add starts retaining the plot.
+func (r *retainer) add(path string, size int64, sent time.Time, confirmed bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.plots = append(r.plots, &retainedPlot{
+		path:      path,
+		size:      size,
+		sent:      sent,
+		confirmed: confirmed,
+	})
+	r.save()
+}
+
+// load picks back up the kept plots recorded in the state file of the plotter
+// path which are still there.
+func (r *retainer) load(dir string) {
+	data, err := os.ReadFile(filepath.Join(dir, retainStateFile))
+	if os.IsNotExist(err) {
+		return
+	}
+	var states []*retainedState
+	if err == nil {
+		err = json.Unmarshal(data, &states)
+	}
+	if err != nil {
+		log.Printf("Failed to load retained plots for %s: %v", dir, err)
+		return
+	}
+
+	count := 0
+	for _, state := range states {
+		path := filepath.Join(dir, state.Name)
+		fi, err := os.Stat(path)
+		if err != nil || fi.Size() != state.Size {
+			continue
+		}
+		r.plots = append(r.plots, &retainedPlot{
+			path:      path,
+			size:      state.Size,
+			sent:      state.Sent,
+			confirmed: state.Confirmed,
+		})
+		count++
+	}
+	if count > 0 {
+		log.Printf("Retaining %d plots already sent from %s", count, dir)
+	}
+}
+
+// save records the kept plots in the state file of each plotter path. It is
+// only needed in keep mode, and must be called with the mutex held.
+func (r *retainer) save() {
+	if sentMode != sentModeKeep {
+		return
+	}
+
+	states := make(map[string][]*retainedState, len(plotterPaths))
+	for _, path := range plotterPaths {
+		states[path] = make([]*retainedState, 0)
+	}
+	for _, p := range r.plots {
+		dir := filepath.Dir(p.path)
+		states[dir] = append(states[dir], &retainedState{
+			Name:      filepath.Base(p.path),
+			Size:      p.size,
+			Sent:      p.sent,
+			Confirmed: p.confirmed,
+		})
+	}
+
+	for dir, list := range states {
+		if err := writeState(filepath.Join(dir, retainStateFile), list); err != nil {
+			log.Printf("Failed to save retained plots for %s: %v", dir, err)
+		}
+	}
+}
+
+// writeState atomically replaces the state file with the plots.
+func writeState(path string, states []*retainedState) error {
+	data, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	tmpfile := path + ".tmp"
+	if err := os.WriteFile(tmpfile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, path)
+}
+
+// has returns whether the plot is being retained after it was sent.
+func (r *retainer) has(path string) bool {
+	if r == nil {
+		return false
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return slices.ContainsFunc(r.plots, func(p *retainedPlot) bool {
+		return p.path == path
+	})
+}
+
+// Run periodically checks the retained plots until the context is done.
+func (r *retainer) Run(ctx context.Context) {
+	ticker := time.NewTicker(retainCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.check(ctx)
+		}
+	}
+}
+
+// check confirms retained plots are on a harvester and deletes any which no
+// longer need to be kept.
+func (r *retainer) check(ctx context.Context) {
+	r.mutex.Lock()
+	plots := slices.Clone(r.plots)
+	r.mutex.Unlock()
+
+	// oldest first, so they are the first to go when space is low
+	slices.SortFunc(plots, func(a, b *retainedPlot) int {
+		return a.sent.Compare(b.sent)
+	})
+
+	// confirm the plots with a single request rather than one for each
+	unconfirmed := make(map[string]int64)
+	for _, p := range plots {
+		if !p.confirmed {
+			unconfirmed[p.path] = p.size
+		}
+	}
+	var located map[string][]string
+	if len(unconfirmed) > 0 {
+		var err error
+		located, _, err = locatePlots(ctx, r.client, unconfirmed)
+		if err != nil {
+			log.Printf("Failed to confirm retained plots: %v", err)
+		}
+	}
+
+	removed := make(map[*retainedPlot]bool)
+	for _, p := range plots {
+		if !p.confirmed {
+			hosts := located[p.path]
+			if len(hosts) == 0 {
+				continue
+			}
+			log.Printf("Plot %s confirmed on %s", p.path, strings.Join(hosts, ", "))
+			p.confirmed = true
+		}
+
+		if time.Since(p.sent) < retainAge && !belowWatermark(filepath.Dir(p.path)) {
+			continue
+		}
+
+		log.Printf("Removing retained plot %s", p.path)
+		if err := os.Remove(p.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove retained plot %s: %v", p.path, err)
+			continue
+		}
+		removed[p] = true
+	}
+
+	r.mutex.Lock()
+	r.plots = slices.DeleteFunc(r.plots, func(p *retainedPlot) bool {
+		return removed[p]
+	})
+	r.save()
+	r.mutex.Unlock()
+}
+
+// belowWatermark returns whether the disk the path is on has less free space
+// than the retention policy allows.
+func belowWatermark(path string) bool {
+	if retainMinFree <= 0 {
+		return false
+	}
+
+	free, ok := freePercent(path)
+	return ok && free < uint64(retainMinFree)
+}
+
+// finishPlot is called once a harvester has the plot, and either deletes it or
+// retains it based on the configured mode. The plot is marked as confirmed if
+// a harvester has already been found with it.
+func finishPlot(plot string, size int64, confirmed bool) {
+	// nothing to keep if the harvester moved it locally
+	if _, err := os.Stat(plot); os.IsNotExist(err) {
+		return
+	}
+
+	switch sentMode {
+	case sentModeKeep:
+		retained.add(plot, size, time.Now(), confirmed)
+
+	case sentModeArchive:
+		dest := filepath.Join(archiveDir, filepath.Base(plot))
+		if err := moveFile(plot, dest); err != nil {
+			log.Printf("Failed to archive plot %s, keeping it in place: %v", plot, err)
+			dest = plot
+		}
+		retained.add(dest, size, time.Now(), confirmed)
+
+	default:
+		os.Remove(plot)
+	}
+}
+
+// moveFile moves the plot to the destination, such as the archive or an
+// overflow path. If the destination is on a different filesystem, it is copied
+// and then the original removed.
+func moveFile(plot, dest string) error {
+	err := os.Rename(plot, dest)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	src, err := os.Open(plot)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpfile := dest + ".tmp"
+	dst, err := os.Create(tmpfile)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(tmpfile)
+		return err
+	}
+
+	// the original is removed once copied, so make sure the copy is on disk
+	// first and won't be lost on a crash
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		os.Remove(tmpfile)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	if err := os.Rename(tmpfile, dest); err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	if err := syncDir(filepath.Dir(dest)); err != nil {
+		return err
+	}
+	return os.Remove(plot)
+}
+
+// syncDir will fsync the specified directory.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
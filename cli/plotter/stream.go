@@ -0,0 +1,186 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package plotter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/krobertson/chia-garden/pkg/rpc"
+	"github.com/krobertson/chia-garden/pkg/transfer"
+	"github.com/krobertson/chia-garden/pkg/types"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	// transportHTTP sends plots directly to the harvester over HTTP.
+	transportHTTP = "http"
+
+	// transportNats streams plots to the harvester as chunks over NATS.
+	transportNats = "nats"
+
+	// transportAuto uses HTTP if the harvester can be reached, and otherwise
+	// falls back to NATS.
+	transportAuto = "auto"
+
+	// streamChunkSize is the largest chunk sent in a single NATS message. It
+	// is further limited by the server's max payload.
+	streamChunkSize = 512 << 10
+
+	// streamWindow is how many chunks can be awaiting acknowledgement.
+	streamWindow = 16
+
+	// streamAckTimeout is how long to wait for a chunk to be acknowledged
+	// before rewinding to where the harvester is.
+	streamAckTimeout = 30 * time.Second
+
+	// streamRetries is how many times the stream can be resumed without any
+	// progress being made before giving up.
+	streamRetries = 5
+)
+
+// useNats returns whether the plot should be streamed over NATS rather than
+// sent to the harvester's url, based on the configured transport.
+func useNats(harvesterUrl string) bool {
+	switch transport {
+	case transportNats:
+		return true
+	case transportAuto:
+		u, err := url.Parse(harvesterUrl)
+		if err != nil {
+			return true
+		}
+		conn, err := net.DialTimeout("tcp", u.Host, 5*time.Second)
+		if err != nil {
+			log.Printf("Unable to reach harvester at %s, falling back to NATS: %v", u.Host, err)
+			return true
+		}
+		conn.Close()
+	}
+	return false
+}
+
+// streamPlot sends the plot to the harvester as chunks over NATS. If the
+// stream stalls or chunks are lost, it resumes from the offset the harvester
+// last received. Once all data is sent, the checksum of the whole plot is sent
+// for the harvester to verify. It returns the status code the harvester
+// responded with.
+func streamPlot(ctx context.Context, client *rpc.NatsPlotterClient, f *os.File, resp *types.PlotResponse, size int64, progress *transfer.Progress) (int, error) {
+	req := &types.PlotStreamRequest{
+		Name:  filepath.Base(f.Name()),
+		Size:  uint64(size),
+		Store: resp.Store,
+	}
+
+	chunkSize := min(streamChunkSize, client.MaxPayload()-4096)
+	lastOffset := int64(-1)
+	var s *rpc.NatsPlotStream
+
+	for retries := 0; retries < streamRetries; {
+		start, err := client.PlotStreamStart(ctx, resp.Hostname, req)
+		if err != nil {
+			return 0, err
+		}
+
+		// only count retries where no progress was made
+		if int64(start.Offset) > lastOffset {
+			retries = 0
+		} else {
+			retries++
+		}
+		lastOffset = int64(start.Offset)
+
+		s, err = client.NewPlotStream(start.Subject)
+		if err != nil {
+			return 0, err
+		}
+
+		checksum, err := sendStream(ctx, s, f, int64(start.Offset), size, chunkSize, progress)
+		if errors.Is(err, transfer.ErrCancelled) {
+			s.Abort(ctx)
+			s.Close()
+			return 0, err
+		}
+		if err != nil {
+			log.Printf("Stream of plot %s interrupted, resuming: %v", f.Name(), err)
+			s.Close()
+			continue
+		}
+
+		result, err := s.Commit(ctx, &types.PlotStreamCommit{
+			Name:     req.Name,
+			Store:    req.Store,
+			Checksum: checksum,
+		}, commitTimeout)
+		if err != nil {
+			// release the harvester, which is a no-op if it already stored it
+			s.Abort(ctx)
+			s.Close()
+			return 0, err
+		}
+		s.Close()
+		return result.Status, nil
+	}
+
+	// give up and release the harvester
+	s.Abort(ctx)
+	return 0, fmt.Errorf("%w: stream of plot %s made no progress after %d attempts", transfer.ErrStalled, f.Name(), streamRetries)
+}
+
+// sendStream sends the plot from the offset in chunks, keeping up to a window
+// of chunks in flight. It returns the hex encoded SHA256 of the entire plot.
+func sendStream(ctx context.Context, s *rpc.NatsPlotStream, f *os.File, offset, size int64, chunkSize int64, progress *transfer.Progress) (string, error) {
+	// checksum what the harvester already has
+	hash := sha256.New()
+	if offset > 0 {
+		log.Printf("Resuming stream of plot %s at %s", f.Name(), humanize.IBytes(uint64(offset)))
+		if _, err := io.Copy(hash, io.NewSectionReader(f, 0, offset)); err != nil {
+			return "", err
+		}
+	}
+
+	progress.Set(offset)
+	r := sectionReader(f, offset, size-offset, progress)
+	buf := make([]byte, chunkSize)
+	pending := make([]int64, 0, streamWindow)
+	sent := offset
+
+	for sent < size || len(pending) > 0 {
+		// fill the window
+		for sent < size && len(pending) < streamWindow {
+			n, err := io.ReadFull(r, buf[:min(chunkSize, size-sent)])
+			if err != nil {
+				return "", err
+			}
+			hash.Write(buf[:n])
+			if err := s.SendChunk(uint64(sent), buf[:n]); err != nil {
+				return "", err
+			}
+			sent += int64(n)
+			pending = append(pending, sent)
+		}
+
+		// wait for the oldest chunk to be acknowledged
+		ack, err := s.NextAck(ctx, streamAckTimeout)
+		if err != nil {
+			return "", err
+		}
+		if int64(ack.Offset) != pending[0] {
+			return "", fmt.Errorf("harvester is at offset %d, expected %d", ack.Offset, pending[0])
+		}
+		pending = pending[1:]
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
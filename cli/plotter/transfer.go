@@ -0,0 +1,254 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package plotter
+
+import (
+	"context"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/krobertson/chia-garden/pkg/rpc"
+	"github.com/krobertson/chia-garden/pkg/transfer"
+	"github.com/krobertson/chia-garden/pkg/types"
+	"github.com/krobertson/chia-garden/pkg/utils"
+)
+
+const (
+	// ioModeBuffered reads plots through the page cache as normal.
+	ioModeBuffered = "buffered"
+
+	// ioModeFadvise advises the kernel the plot is read sequentially and
+	// drops pages from the page cache as they're sent.
+	ioModeFadvise = "fadvise"
+)
+
+// httpTransport is used for sending plots to harvesters. Connections which
+// can't be established or go quiet fail rather than hanging, and a transfer
+// which stops making progress is cancelled by its stall watchdog.
+var httpTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 5 * time.Second,
+	IdleConnTimeout:       90 * time.Second,
+	MaxIdleConnsPerHost:   16,
+}
+
+// sectionReader returns a reader for length bytes of the plot starting at
+// offset, based on the configured IO mode. Bytes read are recorded on the
+// transfer's progress.
+func sectionReader(f *os.File, offset, length int64, progress *transfer.Progress) io.Reader {
+	if ioMode == ioModeFadvise {
+		return progress.Reader(utils.NewDropBehindReader(f, offset, length))
+	}
+	return progress.Reader(io.NewSectionReader(f, offset, length))
+}
+
+// transferPlot sends the plot to the harvester which responded, picking how
+// based on where the harvester is and how the plotter is configured. The plot
+// may only be moved locally if this is the last copy being sent. It returns the
+// status code the harvester responded with.
+func transferPlot(ctx context.Context, client *rpc.NatsPlotterClient, plot string, f *os.File, pending *pendingPull, resp *types.PlotResponse, size int64, last bool) (int, error) {
+	if localMove && last && isLocal(resp) && resp.Protocol.Has(types.CapMove) {
+		log.Printf("Moving plot %s locally to %s", plot, resp.Store)
+		status, err := movePlot(ctx, client, plot, resp, uint64(size))
+		if err == nil {
+			return status, nil
+		}
+		log.Printf("Unable to move plot %s locally, sending instead: %v", plot, err)
+	}
+
+	progress := tracker.Start(filepath.Base(plot), resp.Hostname, size)
+	defer tracker.Finish(progress)
+
+	status, err := sendPlotVia(ctx, client, plot, f, pending, resp, size, progress)
+	if cerr := progress.Cancelled(); cerr != nil {
+		return 0, cerr
+	}
+	return status, err
+}
+
+// sendPlotVia sends the plot over the transport configured for the plotter.
+// Transports and features the harvester doesn't support fall back to sending
+// the plot over a single HTTP request.
+func sendPlotVia(ctx context.Context, client *rpc.NatsPlotterClient, plot string, f *os.File, pending *pendingPull, resp *types.PlotResponse, size int64, progress *transfer.Progress) (int, error) {
+	if pending != nil {
+		if resp.Protocol.Has(types.CapPull) {
+			log.Printf("Plot %s being pulled by %s:%s", plot, resp.Hostname, resp.Store)
+			return pullPlot(ctx, client, pending, f, resp, progress)
+		}
+		log.Printf("Harvester %s doesn't support pulling plots, sending it instead", resp.Hostname)
+	}
+
+	if useNats(resp.Url) {
+		if resp.Protocol.Has(types.CapStream) {
+			log.Printf("Streaming plot %s over NATS to %s:%s", plot, resp.Hostname, resp.Store)
+			return streamPlot(ctx, client, f, resp, size, progress)
+		}
+		log.Printf("Harvester %s doesn't support streaming plots over NATS, sending it over HTTP instead", resp.Hostname)
+	}
+
+	log.Printf("Sending plot %s to %s:%s", plot, resp.Hostname, resp.Store)
+	if streams > 1 && resp.Protocol.Has(types.CapRanged) {
+		return sendPlotRanged(resp.Url, f, size, progress)
+	}
+	return sendPlot(resp.Url, f, size, progress)
+}
+
+// sendPlot transfers the whole plot to the harvester in a single request and
+// returns the status code the harvester responded with.
+func sendPlot(url string, f *os.File, size int64, progress *transfer.Progress) (int, error) {
+	ctx, stop := transfer.Watch(progress, stallTimeout, commitTimeout)
+	defer stop()
+
+	httpreq, err := http.NewRequestWithContext(ctx, "POST", url, sectionReader(f, 0, size, progress))
+	if err != nil {
+		return 0, err
+	}
+	httpreq.ContentLength = size
+	httpreq.Header.Set("Expect", "100-continue")
+
+	httpresp, err := httpTransport.RoundTrip(httpreq)
+	if err != nil {
+		return 0, transfer.Cause(ctx, err)
+	}
+	defer httpresp.Body.Close()
+	logDecline(httpresp)
+	return httpresp.StatusCode, nil
+}
+
+// sendPlotRanged transfers the plot to the harvester by splitting it into byte
+// ranges and uploading them over multiple concurrent requests. Once all of the
+// ranges are sent, a commit request is sent with the checksum of each range
+// for the harvester to verify before storing the plot. If any range fails, the
+// upload is aborted on the harvester.
+func sendPlotRanged(url string, f *os.File, size int64, progress *transfer.Progress) (int, error) {
+	ctx, stop := transfer.Watch(progress, stallTimeout, commitTimeout)
+	defer stop()
+
+	ranges := transfer.SplitRanges(size, streams)
+
+	// the first range to fail stops the others, rather than leaving them to
+	// send the rest of the plot before the failure is reported
+	rctx, cancelRanges := context.WithCancel(ctx)
+	defer cancelRanges()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var failedStatus int
+	var failedErr error
+	for i := range ranges {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			status, err := sendRange(rctx, url, f, &ranges[i], size, progress)
+			if err == nil && status == 202 {
+				return
+			}
+			once.Do(func() {
+				failedStatus, failedErr = status, err
+				cancelRanges()
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	// abort the upload if any range failed
+	if failedStatus != 0 || failedErr != nil {
+		abortRanged(url)
+		return failedStatus, failedErr
+	}
+
+	// commit the upload
+	httpreq, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		abortRanged(url)
+		return 0, err
+	}
+	httpreq.Header.Set(transfer.HeaderCommitRanges, transfer.FormatRanges(ranges))
+
+	httpresp, err := httpTransport.RoundTrip(httpreq)
+	if err != nil {
+		abortRanged(url)
+		return 0, transfer.Cause(ctx, err)
+	}
+	defer httpresp.Body.Close()
+	logDecline(httpresp)
+	return httpresp.StatusCode, nil
+}
+
+// sendRange uploads a single range of the plot, computing its checksum as it
+// is sent.
+func sendRange(ctx context.Context, url string, f *os.File, r *transfer.Range, size int64, progress *transfer.Progress) (int, error) {
+	crc := crc32.New(transfer.Castagnoli)
+	body := io.TeeReader(sectionReader(f, r.Start, r.Len(), progress), crc)
+
+	httpreq, err := http.NewRequestWithContext(ctx, "POST", url, body)
+	if err != nil {
+		return 0, err
+	}
+	httpreq.ContentLength = r.Len()
+	httpreq.Header.Set("Content-Range", transfer.FormatContentRange(*r, size))
+	httpreq.Header.Set("Expect", "100-continue")
+
+	httpresp, err := httpTransport.RoundTrip(httpreq)
+	if err != nil {
+		return 0, transfer.Cause(ctx, err)
+	}
+	defer httpresp.Body.Close()
+	if httpresp.StatusCode != 202 {
+		logDecline(httpresp)
+		return httpresp.StatusCode, nil
+	}
+
+	r.Checksum = crc.Sum32()
+	return httpresp.StatusCode, nil
+}
+
+// logDecline logs the reason the harvester gave for declining a plot, if the
+// response includes one. Since plots are sent with "Expect: 100-continue", a
+// declined plot is rejected before any of it is sent.
+func logDecline(httpresp *http.Response) {
+	if httpresp.StatusCode < 300 || httpresp.Header.Get("Content-Type") != "application/json" {
+		return
+	}
+
+	var derr types.TransferError
+	if err := json.NewDecoder(io.LimitReader(httpresp.Body, 4096)).Decode(&derr); err != nil {
+		return
+	}
+	u := httpresp.Request.URL
+	log.Printf("Harvester %s declined plot %s with %d (%s): %s", u.Host, u.Path, derr.Status, derr.Reason, derr.Message)
+}
+
+// abortRanged tells the harvester to discard a partial multi-stream upload so
+// the disk is released right away.
+func abortRanged(url string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	httpreq, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
+	if err != nil {
+		return
+	}
+	httpresp, err := httpTransport.RoundTrip(httpreq)
+	if err != nil {
+		log.Printf("Failed to abort upload to %s: %v", url, err)
+		return
+	}
+	httpresp.Body.Close()
+	if httpresp.StatusCode != 204 && httpresp.StatusCode != 404 {
+		log.Printf("Unexpected %d status code aborting upload to %s", httpresp.StatusCode, url)
+	}
+}
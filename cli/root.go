@@ -3,8 +3,12 @@
 package cli
 
 import (
+	"log"
 	"os"
 	"strings"
+	"time"
+
+	"github.com/krobertson/chia-garden/pkg/rpc"
 
 	"github.com/nats-io/nats.go"
 	"github.com/spf13/cobra"
@@ -20,9 +24,30 @@ var (
 freshly created plots from plotter machines to harvester machines. It makes
 it easy to manage a farm as it grows from small to large, while also
 balancing storage across multiple nodes and disks.`,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if err := rpc.SetSubjectPrefix(SubjectPrefix); err != nil {
+				log.Fatal(err)
+			}
+		},
 	}
 
-	NatsUrl string
+	NatsUrl       string
+	SubjectPrefix string
+	InboxPrefix   string
+
+	natsCreds           string
+	natsNkey            string
+	natsUser            string
+	natsPassword        string
+	natsToken           string
+	natsTLSCert         string
+	natsTLSKey          string
+	natsTLSCA           string
+	natsName            string
+	natsMaxReconnects   int
+	natsReconnectWait   time.Duration
+	natsReconnectJitter time.Duration
+	natsTimeout         time.Duration
 )
 
 func Execute() {
@@ -34,13 +59,73 @@ func Execute() {
 
 func init() {
 	viper.SetDefault("nats_url", nats.DefaultURL)
+	viper.SetDefault("subject_prefix", rpc.DefaultSubjectPrefix)
+	viper.SetDefault("inbox_prefix", "")
+	viper.SetDefault("nats_creds", "")
+	viper.SetDefault("nats_nkey", "")
+	viper.SetDefault("nats_user", "")
+	viper.SetDefault("nats_password", "")
+	viper.SetDefault("nats_token", "")
+	viper.SetDefault("nats_tls_cert", "")
+	viper.SetDefault("nats_tls_key", "")
+	viper.SetDefault("nats_tls_ca", "")
+	viper.SetDefault("nats_name", "")
+	viper.SetDefault("nats_max_reconnects", -1)
+	viper.SetDefault("nats_reconnect_wait", nats.DefaultReconnectWait)
+	viper.SetDefault("nats_reconnect_jitter", nats.DefaultReconnectJitter)
+	viper.SetDefault("nats_timeout", nats.DefaultTimeout)
 
 	viper.SetEnvPrefix("garden")
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.BindEnv("nats_url")
+	viper.BindEnv("subject_prefix")
+	viper.BindEnv("inbox_prefix")
+	viper.BindEnv("nats_creds")
+	viper.BindEnv("nats_nkey")
+	viper.BindEnv("nats_user")
+	viper.BindEnv("nats_password")
+	viper.BindEnv("nats_token")
+	viper.BindEnv("nats_tls_cert")
+	viper.BindEnv("nats_tls_key")
+	viper.BindEnv("nats_tls_ca")
+	viper.BindEnv("nats_name")
+	viper.BindEnv("nats_max_reconnects")
+	viper.BindEnv("nats_reconnect_wait")
+	viper.BindEnv("nats_reconnect_jitter")
+	viper.BindEnv("nats_timeout")
 
-	RootCmd.PersistentFlags().StringVarP(&NatsUrl, "nats", "n", viper.GetString("nats_url"), "NATS connection string")
+	RootCmd.PersistentFlags().StringVarP(&NatsUrl, "nats", "n", viper.GetString("nats_url"), "NATS connection string, multiple servers can be comma separated")
+	RootCmd.PersistentFlags().StringVarP(&natsCreds, "nats-creds", "", viper.GetString("nats_creds"), "NATS credentials file")
+	RootCmd.PersistentFlags().StringVarP(&natsNkey, "nats-nkey", "", viper.GetString("nats_nkey"), "NATS nkey seed file")
+	RootCmd.PersistentFlags().StringVarP(&natsUser, "nats-user", "", viper.GetString("nats_user"), "NATS username")
+	RootCmd.PersistentFlags().StringVarP(&natsPassword, "nats-password", "", viper.GetString("nats_password"), "NATS password")
+	RootCmd.PersistentFlags().StringVarP(&natsToken, "nats-token", "", viper.GetString("nats_token"), "NATS authentication token")
+	RootCmd.PersistentFlags().StringVarP(&natsTLSCert, "nats-tls-cert", "", viper.GetString("nats_tls_cert"), "NATS TLS client certificate file")
+	RootCmd.PersistentFlags().StringVarP(&natsTLSKey, "nats-tls-key", "", viper.GetString("nats_tls_key"), "NATS TLS client key file")
+	RootCmd.PersistentFlags().StringVarP(&natsTLSCA, "nats-tls-ca", "", viper.GetString("nats_tls_ca"), "NATS TLS certificate authority file")
+	RootCmd.PersistentFlags().StringVarP(&natsName, "nats-name", "", viper.GetString("nats_name"), "Name to identify the NATS connection")
+	RootCmd.PersistentFlags().IntVarP(&natsMaxReconnects, "nats-max-reconnects", "", viper.GetInt("nats_max_reconnects"), "Max NATS reconnect attempts, -1 for unlimited")
+	RootCmd.PersistentFlags().DurationVarP(&natsReconnectWait, "nats-reconnect-wait", "", viper.GetDuration("nats_reconnect_wait"), "How long to wait between NATS reconnect attempts")
+	RootCmd.PersistentFlags().DurationVarP(&natsReconnectJitter, "nats-reconnect-jitter", "", viper.GetDuration("nats_reconnect_jitter"), "Random jitter added to the NATS reconnect wait")
+	RootCmd.PersistentFlags().DurationVarP(&natsTimeout, "nats-timeout", "", viper.GetDuration("nats_timeout"), "Timeout for connecting to NATS")
+	RootCmd.PersistentFlags().StringVarP(&SubjectPrefix, "subject-prefix", "", viper.GetString("subject_prefix"), "Prefix of the NATS subjects, to separate farms sharing a server")
+	RootCmd.PersistentFlags().StringVarP(&InboxPrefix, "inbox-prefix", "", viper.GetString("inbox_prefix"), "Prefix of the NATS subjects replies are received on")
 	RootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 
 	viper.BindPFlag("nats_url", RootCmd.Flags().Lookup("nats"))
+	viper.BindPFlag("subject_prefix", RootCmd.PersistentFlags().Lookup("subject-prefix"))
+	viper.BindPFlag("inbox_prefix", RootCmd.PersistentFlags().Lookup("inbox-prefix"))
+	viper.BindPFlag("nats_creds", RootCmd.PersistentFlags().Lookup("nats-creds"))
+	viper.BindPFlag("nats_nkey", RootCmd.PersistentFlags().Lookup("nats-nkey"))
+	viper.BindPFlag("nats_user", RootCmd.PersistentFlags().Lookup("nats-user"))
+	viper.BindPFlag("nats_password", RootCmd.PersistentFlags().Lookup("nats-password"))
+	viper.BindPFlag("nats_token", RootCmd.PersistentFlags().Lookup("nats-token"))
+	viper.BindPFlag("nats_tls_cert", RootCmd.PersistentFlags().Lookup("nats-tls-cert"))
+	viper.BindPFlag("nats_tls_key", RootCmd.PersistentFlags().Lookup("nats-tls-key"))
+	viper.BindPFlag("nats_tls_ca", RootCmd.PersistentFlags().Lookup("nats-tls-ca"))
+	viper.BindPFlag("nats_name", RootCmd.PersistentFlags().Lookup("nats-name"))
+	viper.BindPFlag("nats_max_reconnects", RootCmd.PersistentFlags().Lookup("nats-max-reconnects"))
+	viper.BindPFlag("nats_reconnect_wait", RootCmd.PersistentFlags().Lookup("nats-reconnect-wait"))
+	viper.BindPFlag("nats_reconnect_jitter", RootCmd.PersistentFlags().Lookup("nats-reconnect-jitter"))
+	viper.BindPFlag("nats_timeout", RootCmd.PersistentFlags().Lookup("nats-timeout"))
 }
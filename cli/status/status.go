@@ -0,0 +1,96 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package status
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/krobertson/chia-garden/cli"
+	"github.com/krobertson/chia-garden/pkg/rpc"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+// statusCmd represents the status command
+var (
+	StatusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show the harvesters which are online",
+		Long: `"chia-garden status" asks the harvesters for their current state and
+displays the harvesters which are online, along with their disk space and
+transfers. With --watch, it follows their heartbeats and logs harvesters which
+join, drain or go silent.`,
+		Run: cmdStatus,
+	}
+
+	statusWait    time.Duration
+	watch         bool
+	watchInterval time.Duration
+)
+
+func init() {
+	cli.RootCmd.AddCommand(StatusCmd)
+
+	StatusCmd.Flags().DurationVarP(&statusWait, "wait", "", 2*time.Second, "How long to wait for harvesters to respond")
+	StatusCmd.Flags().BoolVarP(&watch, "watch", "w", false, "Continuously follow the harvesters' heartbeats")
+	StatusCmd.Flags().DurationVarP(&watchInterval, "interval", "", rpc.DefaultHeartbeatInterval, "How often to print the harvesters when watching")
+}
+
+func cmdStatus(cmd *cobra.Command, args []string) {
+	conn, err := cli.Connect("chia-garden status")
+	if err != nil {
+		log.Fatal("Failed to connect to NATS: ", err)
+	}
+	defer conn.Close()
+
+	members, err := rpc.WatchMembership(conn, watch)
+	if err != nil {
+		log.Fatal("Failed to watch harvester heartbeats: ", err)
+	}
+	defer members.Close()
+
+	if err := members.Refresh(context.Background(), statusWait); err != nil {
+		log.Fatal("Failed to request harvester state: ", err)
+	}
+
+	if !watch {
+		list := members.List()
+		if len(list) == 0 {
+			fmt.Println("No harvesters are online")
+			os.Exit(1)
+		}
+		printMembers(list)
+		return
+	}
+
+	for {
+		printMembers(members.List())
+		time.Sleep(watchInterval)
+	}
+}
+
+// printMembers prints a table of the harvesters.
+func printMembers(list []*rpc.Member) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tSTATE\tPROTOCOL\tURL\tPATHS\tPLOTS\tFREE\tTRANSFERS\tLAST SEEN")
+	for _, m := range list {
+		state := "online"
+		switch {
+		case m.Silent:
+			state = "silent"
+		case m.Draining:
+			state = "draining"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d (%d busy)\t%d\t%s / %s\t%d / %d\t%s ago\n",
+			m.Hostname, state, m.Protocol.Version, m.Url, m.Paths, m.BusyPaths, m.Plots,
+			humanize.IBytes(m.FreeSpace), humanize.IBytes(m.TotalSpace), m.Transfers, m.MaxTransfers,
+			time.Since(m.LastSeen).Round(time.Second))
+	}
+	w.Flush()
+}
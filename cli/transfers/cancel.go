@@ -0,0 +1,72 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package transfers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/krobertson/chia-garden/cli"
+	"github.com/krobertson/chia-garden/pkg/rpc"
+	"github.com/krobertson/chia-garden/pkg/types"
+
+	"github.com/spf13/cobra"
+)
+
+// cancelCmd represents the transfers cancel command
+var (
+	CancelCmd = &cobra.Command{
+		Use:   "cancel <plot>",
+		Short: "Cancel the transfer of a plot",
+		Long: `"chia-garden transfers cancel" aborts any transfers of the plot on the
+plotters and harvesters, removing the partial file from the harvester. By
+default the plotter will requeue the plot to be sent again, or with --park it
+will leave it in place until the plotter is restarted.`,
+		Args: cobra.ExactArgs(1),
+		Run:  cmdCancel,
+	}
+
+	park       bool
+	cancelWait time.Duration
+)
+
+func init() {
+	TransfersCmd.AddCommand(CancelCmd)
+
+	CancelCmd.Flags().BoolVarP(&park, "park", "", false, "Leave the plot on the plotter instead of requeuing it")
+	CancelCmd.Flags().DurationVarP(&cancelWait, "wait", "", 2*time.Second, "How long to wait for hosts to respond")
+}
+
+func cmdCancel(cmd *cobra.Command, args []string) {
+	conn, err := cli.Connect("chia-garden transfers cancel")
+	if err != nil {
+		log.Fatal("Failed to connect to NATS: ", err)
+	}
+	defer conn.Close()
+
+	name := filepath.Base(args[0])
+	responses, err := rpc.CancelTransfer(context.Background(), conn, &types.TransferCancelRequest{
+		Name: name,
+		Park: park,
+	}, cancelWait)
+	if err != nil {
+		log.Fatal("Failed to cancel transfer: ", err)
+	}
+
+	if len(responses) == 0 {
+		fmt.Printf("No transfers of %s were found\n", name)
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tROLE\tCANCELLED")
+	for _, resp := range responses {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", resp.Hostname, resp.Role, resp.Cancelled)
+	}
+	w.Flush()
+}
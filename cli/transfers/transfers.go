@@ -0,0 +1,112 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package transfers
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/krobertson/chia-garden/cli"
+	"github.com/krobertson/chia-garden/pkg/rpc"
+	"github.com/krobertson/chia-garden/pkg/types"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+// transfersCmd represents the transfers command
+var (
+	TransfersCmd = &cobra.Command{
+		Use:   "transfers",
+		Short: "Show the plot transfers currently in progress",
+		Long: `"chia-garden transfers" listens for the progress reported by plotters and
+harvesters and displays the transfers currently in progress across the farm.`,
+		Run: cmdTransfers,
+	}
+
+	listenDuration time.Duration
+	watch          bool
+)
+
+func init() {
+	cli.RootCmd.AddCommand(TransfersCmd)
+
+	TransfersCmd.Flags().DurationVarP(&listenDuration, "duration", "d", 35*time.Second, "How long to listen for progress reports")
+	TransfersCmd.Flags().BoolVarP(&watch, "watch", "w", false, "Continuously print progress reports as they're received")
+}
+
+func cmdTransfers(cmd *cobra.Command, args []string) {
+	conn, err := cli.Connect("chia-garden transfers")
+	if err != nil {
+		log.Fatal("Failed to connect to NATS: ", err)
+	}
+	defer conn.Close()
+
+	// in watch mode, print each report as it comes in
+	if watch {
+		_, err := rpc.SubscribeTransferProgress(conn, func(p *types.TransferProgress) {
+			fmt.Println(formatProgress(p))
+		})
+		if err != nil {
+			log.Fatal("Failed to subscribe to progress: ", err)
+		}
+		<-make(chan struct{})
+	}
+
+	// otherwise collect the latest report for each transfer
+	transfers := make(map[string]*types.TransferProgress)
+	var mutex sync.Mutex
+	sub, err := rpc.SubscribeTransferProgress(conn, func(p *types.TransferProgress) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		key := p.Hostname + "|" + p.Role + "|" + p.Name
+		if p.Finished {
+			delete(transfers, key)
+			return
+		}
+		transfers[key] = p
+	})
+	if err != nil {
+		log.Fatal("Failed to subscribe to progress: ", err)
+	}
+
+	time.Sleep(listenDuration)
+	sub.Unsubscribe()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	list := make([]*types.TransferProgress, 0, len(transfers))
+	for _, p := range transfers {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started.Before(list[j].Started)
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tROLE\tPLOT\tPEER\tPROGRESS\tRATE\tETA")
+	for _, p := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s / %s\t%s/sec\t%s\n",
+			p.Hostname, p.Role, p.Name, p.Peer, humanize.IBytes(p.Bytes), humanize.IBytes(p.Size),
+			humanize.Bytes(p.Rate), (time.Duration(p.Eta) * time.Second).String())
+	}
+	w.Flush()
+}
+
+// formatProgress returns a single line description of the progress report.
+func formatProgress(p *types.TransferProgress) string {
+	if p.Finished {
+		return fmt.Sprintf("%s %s %s with %s finished at %s",
+			p.Hostname, p.Role, p.Name, p.Peer, humanize.IBytes(p.Bytes))
+	}
+	return fmt.Sprintf("%s %s %s with %s: %s / %s, %s/sec, ETA %s",
+		p.Hostname, p.Role, p.Name, p.Peer, humanize.IBytes(p.Bytes), humanize.IBytes(p.Size),
+		humanize.Bytes(p.Rate), (time.Duration(p.Eta) * time.Second).String())
+}
@@ -9,6 +9,8 @@ import (
 
 	_ "github.com/krobertson/chia-garden/cli/harvester"
 	_ "github.com/krobertson/chia-garden/cli/plotter"
+	_ "github.com/krobertson/chia-garden/cli/status"
+	_ "github.com/krobertson/chia-garden/cli/transfers"
 )
 
 func main() {
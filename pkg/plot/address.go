@@ -0,0 +1,117 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package plot
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// bech32Charset is the alphabet used by bech32 encoded addresses.
+	bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+	// bech32mConst is the checksum constant for bech32m, which Chia uses for
+	// its addresses.
+	bech32mConst = 0x2bc830a3
+)
+
+// ParsePuzzleHash parses a puzzle hash given either as hex, optionally with a
+// 0x prefix, or as a bech32m mainnet or testnet address such as xch1...
+func ParsePuzzleHash(s string) ([]byte, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if b, err := hex.DecodeString(strings.TrimPrefix(s, "0x")); err == nil {
+		if len(b) != 32 {
+			return nil, fmt.Errorf("puzzle hash %q must be 32 bytes", s)
+		}
+		return b, nil
+	}
+
+	b, err := decodeAddress(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", s, err)
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("address %q must be for a 32 byte puzzle hash", s)
+	}
+	return b, nil
+}
+
+// ParsePublicKey parses a BLS public key given as hex, optionally with a 0x
+// prefix.
+func ParsePublicKey(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "0x"))
+	if err != nil || len(b) != 48 {
+		return nil, fmt.Errorf("public key %q must be 48 bytes of hex", s)
+	}
+	return b, nil
+}
+
+// decodeAddress decodes the data from a bech32m address, verifying its prefix
+// and checksum.
+func decodeAddress(s string) ([]byte, error) {
+	i := strings.LastIndexByte(s, '1')
+	if i < 1 || i+7 > len(s) {
+		return nil, errors.New("malformed address")
+	}
+	hrp := s[:i]
+	if hrp != "xch" && hrp != "txch" {
+		return nil, fmt.Errorf("unknown prefix %q, must be xch or txch", hrp)
+	}
+
+	values := make([]byte, 0, len(s)-i-1)
+	for _, c := range s[i+1:] {
+		v := strings.IndexRune(bech32Charset, c)
+		if v < 0 {
+			return nil, fmt.Errorf("invalid character %q", c)
+		}
+		values = append(values, byte(v))
+	}
+
+	// the checksum covers the expanded prefix and the data
+	expanded := make([]byte, 0, len(hrp)*2+1+len(values))
+	for _, c := range []byte(hrp) {
+		expanded = append(expanded, c>>5)
+	}
+	expanded = append(expanded, 0)
+	for _, c := range []byte(hrp) {
+		expanded = append(expanded, c&31)
+	}
+	if bech32Polymod(append(expanded, values...)) != bech32mConst {
+		return nil, errors.New("invalid checksum")
+	}
+
+	// convert the 5 bit groups, without the checksum, back into bytes
+	var out []byte
+	var acc, bits uint
+	for _, v := range values[:len(values)-6] {
+		acc = acc<<5 | uint(v)
+		bits += 5
+		if bits >= 8 {
+			bits -= 8
+			out = append(out, byte(acc>>bits))
+		}
+	}
+	if bits >= 5 || acc&(1<<bits-1) != 0 {
+		return nil, errors.New("invalid padding")
+	}
+	return out, nil
+}
+
+// bech32Polymod computes the bech32 checksum over the values.
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
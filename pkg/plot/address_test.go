@@ -0,0 +1,48 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package plot
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestParsePuzzleHash(t *testing.T) {
+	for _, tt := range []struct {
+		in       string
+		expected string
+	}{
+		// the burn address
+		{"xch1qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqm6ks6e8mvy", "000000000000000000000000000000000000000000000000000000000000dead"},
+		{"xch1qqqsyqcyq5rqwzqfpg9scrgwpugpzysnzs23v9ccrydpk8qarc0srg6dkm", "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"},
+		{"txch1qqqsyqcyq5rqwzqfpg9scrgwpugpzysnzs23v9ccrydpk8qarc0sw0amhg", "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"},
+		{"xch1qv9pzxqlyckngw6zf9g9whn9d3eh4qvg37tfmf9tk2uup37w6hwqkt680h", "030a11181f262d343b424950575e656c737a81888f969da4abb2b9c0c7ced5dc"},
+		{" XCH1QV9PZXQLYCKNGW6ZF9G9WHN9D3EH4QVG37TFMF9TK2UUP37W6HWQKT680H ", "030a11181f262d343b424950575e656c737a81888f969da4abb2b9c0c7ced5dc"},
+		{"030a11181f262d343b424950575e656c737a81888f969da4abb2b9c0c7ced5dc", "030a11181f262d343b424950575e656c737a81888f969da4abb2b9c0c7ced5dc"},
+		{"0x030A11181F262D343B424950575E656C737A81888F969DA4ABB2B9C0C7CED5DC", "030a11181f262d343b424950575e656c737a81888f969da4abb2b9c0c7ced5dc"},
+	} {
+		b, err := ParsePuzzleHash(tt.in)
+		if err != nil {
+			t.Errorf("ParsePuzzleHash(%q) returned error: %v", tt.in, err)
+		} else if hex.EncodeToString(b) != tt.expected {
+			t.Errorf("ParsePuzzleHash(%q) returned %x, expected %s", tt.in, b, tt.expected)
+		}
+	}
+}
+
+func TestParsePuzzleHashInvalid(t *testing.T) {
+	for name, in := range map[string]string{
+		"wrong checksum": "xch1qqqsyqcyq5rqwzqfpg9scrgwpugpzysnzs23v9ccrydpk8qarc0srg6dkq",
+		"changed data":   "xch1qqqsyqcyq5rqwzqfpg9scrgwpugpzysnzs23v9ccrydpk8qarc0qrg6dkm",
+		"bech32":         "xch1qqqsyqcyq5rqwzqfpg9scrgwpugpzysnzs23v9ccrydpk8qarc0sk52pne",
+		"wrong prefix":   "bc1qqqsyqcyq5rqwzqfpg9scrgwpugpzysnzs23v9ccrydpk8qarc0sp695jg",
+		"other network":  "txch1qqqsyqcyq5rqwzqfpg9scrgwpugpzysnzs23v9ccrydpk8qarc0srg6dkm",
+		"bad character":  "xch1bqqsyqcyq5rqwzqfpg9scrgwpugpzysnzs23v9ccrydpk8qarc0srg6dkm",
+		"too short":      "xch1qqqqqq",
+		"short hex":      "0x0a11",
+	} {
+		if b, err := ParsePuzzleHash(in); err == nil {
+			t.Errorf("ParsePuzzleHash of %s returned %x, expected an error", name, b)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package plot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+const (
+	// AttrK is the k-size of the plot.
+	AttrK = "k"
+
+	// AttrCompression is the compression level of the plot, 0 if uncompressed.
+	AttrCompression = "compression"
+
+	// AttrPoolContract is the pool contract puzzle hash the plot is for, as
+	// hex. It is only set for plots made for a pool contract.
+	AttrPoolContract = "pool_contract"
+
+	// AttrFarmerKey is the farmer public key the plot is for, as hex.
+	AttrFarmerKey = "farmer_key"
+
+	// AttrPlotter is the hostname of the plotter sending the plot.
+	AttrPlotter = "plotter"
+
+	// poolContractMemoSize is the size of the memo for plots made for a pool
+	// contract: the pool contract puzzle hash, the farmer public key and the
+	// local master secret key.
+	poolContractMemoSize = 32 + 48 + 32
+
+	// poolKeyMemoSize is the size of the memo for plots made for a pool
+	// public key: the pool public key, the farmer public key and the local
+	// master secret key.
+	poolKeyMemoSize = 48 + 48 + 32
+)
+
+var (
+	// magicV1 begins the header of the original, uncompressed plot format.
+	magicV1 = []byte("Proof of Space Plot")
+
+	// magicV2 begins the header of the v2 plot format, which supports
+	// compression.
+	magicV2 = []byte("PLOT")
+
+	// filenamePattern matches the k-size and compression level in standard
+	// plot filenames, such as plot-k32-c07-2024-01-01-00-00-<id>.plot.
+	filenamePattern = regexp.MustCompile(`^plot-k(\d+)(?:-c(\d+))?-`)
+
+	// ErrUnknownFormat is returned when the file isn't a known plot format.
+	ErrUnknownFormat = errors.New("unknown plot format")
+)
+
+// Header is the information stored at the start of a plot file.
+type Header struct {
+	ID          []byte
+	K           int
+	Compression int
+	Memo        []byte
+}
+
+// ReadHeader parses the header of a plot in either the v1 or v2 format.
+func ReadHeader(r io.Reader) (*Header, error) {
+	magic := make([]byte, len(magicV1))
+	if _, err := io.ReadFull(r, magic[:len(magicV2)]); err != nil {
+		return nil, err
+	}
+	v2 := bytes.Equal(magic[:len(magicV2)], magicV2)
+	if !v2 {
+		if _, err := io.ReadFull(r, magic[len(magicV2):]); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(magic, magicV1) {
+			return nil, ErrUnknownFormat
+		}
+	}
+
+	// v2 is followed by the version, and v1 by the format description after
+	// the id and k-size
+	var version uint32
+	if v2 {
+		if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+			return nil, err
+		}
+		if version != 2 {
+			return nil, ErrUnknownFormat
+		}
+	}
+
+	h := &Header{ID: make([]byte, 32)}
+	if _, err := io.ReadFull(r, h.ID); err != nil {
+		return nil, err
+	}
+	var k uint8
+	if err := binary.Read(r, binary.BigEndian, &k); err != nil {
+		return nil, err
+	}
+	h.K = int(k)
+
+	if !v2 {
+		if _, err := readSized(r); err != nil {
+			return nil, err
+		}
+	}
+
+	memo, err := readSized(r)
+	if err != nil {
+		return nil, err
+	}
+	h.Memo = memo
+
+	// v2 flags whether the plot is compressed, followed by the level
+	if v2 {
+		var flags uint32
+		if err := binary.Read(r, binary.LittleEndian, &flags); err != nil {
+			return nil, err
+		}
+		if flags&1 != 0 {
+			var level uint8
+			if err := binary.Read(r, binary.BigEndian, &level); err != nil {
+				return nil, err
+			}
+			h.Compression = int(level)
+		}
+	}
+	return h, nil
+}
+
+// readSized reads a field prefixed with its big endian 16 bit length.
+func readSized(r io.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// PoolContract returns the pool contract puzzle hash from the memo, or nil if
+// the plot was made for a pool public key instead.
+func (h *Header) PoolContract() []byte {
+	if len(h.Memo) != poolContractMemoSize {
+		return nil
+	}
+	return h.Memo[:32]
+}
+
+// FarmerPublicKey returns the farmer public key from the memo, or nil if the
+// memo isn't in a known layout.
+func (h *Header) FarmerPublicKey() []byte {
+	switch len(h.Memo) {
+	case poolContractMemoSize:
+		return h.Memo[32:80]
+	case poolKeyMemoSize:
+		return h.Memo[48:96]
+	}
+	return nil
+}
+
+// Attributes returns the attributes of the plot used for routing it to
+// harvesters. They are read from the plot header, falling back to the
+// filename for formats which can't be parsed.
+func Attributes(path string) map[string]string {
+	attrs := make(map[string]string)
+
+	f, err := os.Open(path)
+	if err == nil {
+		defer f.Close()
+		if h, err := ReadHeader(f); err == nil {
+			attrs[AttrK] = strconv.Itoa(h.K)
+			attrs[AttrCompression] = strconv.Itoa(h.Compression)
+			if pc := h.PoolContract(); pc != nil {
+				attrs[AttrPoolContract] = hex.EncodeToString(pc)
+			}
+			if fk := h.FarmerPublicKey(); fk != nil {
+				attrs[AttrFarmerKey] = hex.EncodeToString(fk)
+			}
+			return attrs
+		}
+	}
+
+	if m := filenamePattern.FindStringSubmatch(filepath.Base(path)); m != nil {
+		attrs[AttrK] = m[1]
+		attrs[AttrCompression] = "0"
+		if m[2] != "" {
+			c, _ := strconv.Atoi(m[2])
+			attrs[AttrCompression] = strconv.Itoa(c)
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,140 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package plot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// testMemo returns a memo for a pool contract plot, with each field filled
+// with a different byte so they can be told apart.
+func testMemo() []byte {
+	memo := bytes.Repeat([]byte{0xaa}, 32)
+	memo = append(memo, bytes.Repeat([]byte{0xbb}, 48)...)
+	return append(memo, bytes.Repeat([]byte{0xcc}, 32)...)
+}
+
+// testID returns a plot id with each byte set to its index.
+func testID() []byte {
+	id := make([]byte, 32)
+	for i := range id {
+		id[i] = byte(i)
+	}
+	return id
+}
+
+// headerV1 builds a header in the layout written by chiapos: the magic, id,
+// k-size, format description and memo, with the sizes big endian.
+func headerV1(k uint8, memo []byte) []byte {
+	var b bytes.Buffer
+	b.Write(magicV1)
+	b.Write(testID())
+	b.WriteByte(k)
+	binary.Write(&b, binary.BigEndian, uint16(4))
+	b.WriteString("v1.0")
+	binary.Write(&b, binary.BigEndian, uint16(len(memo)))
+	b.Write(memo)
+	return b.Bytes()
+}
+
+// headerV2 builds a header in the v2 layout: the magic, little endian version,
+// id, k-size and memo, followed by the little endian flags and the
+// compression level if the plot is compressed.
+func headerV2(k uint8, memo []byte, compression uint8) []byte {
+	var b bytes.Buffer
+	b.Write(magicV2)
+	binary.Write(&b, binary.LittleEndian, uint32(2))
+	b.Write(testID())
+	b.WriteByte(k)
+	binary.Write(&b, binary.BigEndian, uint16(len(memo)))
+	b.Write(memo)
+	if compression > 0 {
+		binary.Write(&b, binary.LittleEndian, uint32(1))
+		b.WriteByte(compression)
+	} else {
+		binary.Write(&b, binary.LittleEndian, uint32(0))
+	}
+	return b.Bytes()
+}
+
+func TestReadHeaderV1(t *testing.T) {
+	h, err := ReadHeader(bytes.NewReader(headerV1(32, testMemo())))
+	if err != nil {
+		t.Fatalf("ReadHeader returned error: %v", err)
+	}
+	if h.K != 32 || h.Compression != 0 {
+		t.Errorf("read k%d c%d, expected k32 c0", h.K, h.Compression)
+	}
+	if !bytes.Equal(h.ID, testID()) {
+		t.Errorf("read id %x, expected %x", h.ID, testID())
+	}
+	if !bytes.Equal(h.PoolContract(), bytes.Repeat([]byte{0xaa}, 32)) {
+		t.Errorf("read pool contract %x", h.PoolContract())
+	}
+	if !bytes.Equal(h.FarmerPublicKey(), bytes.Repeat([]byte{0xbb}, 48)) {
+		t.Errorf("read farmer key %x", h.FarmerPublicKey())
+	}
+}
+
+func TestReadHeaderV2(t *testing.T) {
+	for _, compression := range []uint8{0, 7} {
+		h, err := ReadHeader(bytes.NewReader(headerV2(32, testMemo(), compression)))
+		if err != nil {
+			t.Fatalf("ReadHeader returned error: %v", err)
+		}
+		if h.K != 32 || h.Compression != int(compression) {
+			t.Errorf("read k%d c%d, expected k32 c%d", h.K, h.Compression, compression)
+		}
+		if !bytes.Equal(h.ID, testID()) {
+			t.Errorf("read id %x, expected %x", h.ID, testID())
+		}
+		if !bytes.Equal(h.FarmerPublicKey(), bytes.Repeat([]byte{0xbb}, 48)) {
+			t.Errorf("read farmer key %x", h.FarmerPublicKey())
+		}
+	}
+}
+
+func TestReadHeaderPoolKey(t *testing.T) {
+	// plots for a pool public key have no pool contract
+	memo := bytes.Repeat([]byte{0xaa}, 48)
+	memo = append(memo, bytes.Repeat([]byte{0xbb}, 48)...)
+	memo = append(memo, bytes.Repeat([]byte{0xcc}, 32)...)
+
+	h, err := ReadHeader(bytes.NewReader(headerV1(32, memo)))
+	if err != nil {
+		t.Fatalf("ReadHeader returned error: %v", err)
+	}
+	if h.PoolContract() != nil {
+		t.Errorf("read pool contract %x, expected none", h.PoolContract())
+	}
+	if !bytes.Equal(h.FarmerPublicKey(), bytes.Repeat([]byte{0xbb}, 48)) {
+		t.Errorf("read farmer key %x", h.FarmerPublicKey())
+	}
+}
+
+func TestReadHeaderTruncated(t *testing.T) {
+	for _, header := range [][]byte{headerV1(32, testMemo()), headerV2(32, testMemo(), 7)} {
+		for i := 0; i < len(header); i++ {
+			_, err := ReadHeader(bytes.NewReader(header[:i]))
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("ReadHeader of %d of %d bytes returned %v, expected EOF", i, len(header), err)
+			}
+		}
+	}
+}
+
+func TestReadHeaderUnknownFormat(t *testing.T) {
+	for name, header := range map[string][]byte{
+		"bad magic":  bytes.Repeat([]byte{'x'}, 128),
+		"bad v1":     append([]byte("Proof of Space Plxt"), headerV1(32, testMemo())[len(magicV1):]...),
+		"v2 version": append([]byte("PLOT\x03\x00\x00\x00"), headerV2(32, testMemo(), 0)[8:]...),
+	} {
+		if _, err := ReadHeader(bytes.NewReader(header)); !errors.Is(err, ErrUnknownFormat) {
+			t.Errorf("ReadHeader of %s returned %v, expected ErrUnknownFormat", name, err)
+		}
+	}
+}
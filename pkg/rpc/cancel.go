@@ -0,0 +1,52 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/krobertson/chia-garden/pkg/types"
+	"github.com/nats-io/nats.go"
+)
+
+// CancelTransfer asks all plotters and harvesters to cancel their transfers of
+// the plot. Only hosts which had a matching transfer respond, so it collects
+// responses for the specified amount of time.
+func CancelTransfer(ctx context.Context, client *nats.Conn, req *types.TransferCancelRequest, wait time.Duration) ([]*types.TransferCancelResponse, error) {
+	responses := make([]*types.TransferCancelResponse, 0)
+	err := requestMany(ctx, client, subject(subjTransferCancel), req, wait, func(msg *nats.Msg) bool {
+		var resp *types.TransferCancelResponse
+		if err := decodeResponse(msg, &resp); err != nil {
+			log.Printf("Failed to decode cancel response: %v", err)
+			return false
+		}
+		responses = append(responses, resp)
+		return false
+	})
+	if err == nats.ErrNoResponders {
+		return responses, nil
+	}
+	return responses, err
+}
+
+// SubscribeTransferCancel calls the handler for each request to cancel a
+// transfer. The handler should return nil if it had no matching transfers, so
+// that only hosts which cancelled something respond.
+func SubscribeTransferCancel(client *nats.Conn, handler func(*types.TransferCancelRequest) *types.TransferCancelResponse) (*nats.Subscription, error) {
+	return client.Subscribe(subject(subjTransferCancel), func(msg *nats.Msg) {
+		checkMsg(msg)
+
+		var req *types.TransferCancelRequest
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			log.Println("Failed to unmarshal cancel request")
+			return
+		}
+
+		if resp := handler(req); resp != nil {
+			respond(client, msg, resp, nil)
+		}
+	})
+}
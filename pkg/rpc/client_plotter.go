@@ -3,34 +3,298 @@
 package rpc
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
 	"time"
 
 	"github.com/krobertson/chia-garden/pkg/types"
 	"github.com/nats-io/nats.go"
 )
 
+// Timeouts are how long the plotter waits for responses to each type of
+// request.
+type Timeouts struct {
+	// Ready is how long to collect responses from harvesters for a plot.
+	Ready time.Duration
+
+	// Locate is how long to wait for a harvester which has a plot.
+	Locate time.Duration
+
+	// Request is how long to wait for a harvester to respond to a request
+	// sent directly to it, such as to start a pull or stream.
+	Request time.Duration
+}
+
+// DefaultTimeouts are the timeouts used when others aren't configured.
+var DefaultTimeouts = Timeouts{
+	Ready:   5 * time.Second,
+	Locate:  time.Second,
+	Request: 5 * time.Second,
+}
+
 type NatsPlotterClient struct {
-	client *nats.Conn
+	client   *nats.Conn
+	timeouts Timeouts
 }
 
-func NewNatsPlotterClient(conn *nats.Conn) *NatsPlotterClient {
+func NewNatsPlotterClient(conn *nats.Conn, timeouts Timeouts) *NatsPlotterClient {
 	return &NatsPlotterClient{
-		client: conn,
+		client:   conn,
+		timeouts: timeouts,
 	}
 }
 
-func (d *NatsPlotterClient) PlotReady(plot *types.PlotRequest) (*types.PlotResponse, error) {
+func (d *NatsPlotterClient) MaxPayload() int64 {
+	return d.client.MaxPayload()
+}
+
+// PlotReady asks the harvesters for somewhere to store the plot, returning the
+// first to accept it. The response includes the protocol of the harvester, so
+// the features used to send the plot can be limited to those it supports.
+//
+// If every harvester which responded declined the plot, a *DeclinedError with
+// their reasons is returned. If none responded at all, nats.ErrTimeout or
+// nats.ErrNoResponders is returned.
+func (d *NatsPlotterClient) PlotReady(ctx context.Context, plot *types.PlotRequest) (*types.PlotResponse, error) {
 	var resp *types.PlotResponse
-	if err := request(d.client, subjPlotReady, plot, &resp, time.Second*5); err != nil {
+	declined := &DeclinedError{Declines: make(map[string]*types.TransferError)}
+	err := requestMany(ctx, d.client, subject(subjPlotReady), plot, d.timeouts.Ready, func(msg *nats.Msg) bool {
+		protocol := protocolOf(msg)
+
+		var r *types.PlotResponse
+		err := decodeResponse(msg, &r)
+		var terr *types.TransferError
+		if errors.As(err, &terr) {
+			declined.Declines[protocol.Hostname] = terr
+			return false
+		}
+		if err != nil {
+			log.Printf("Failed to decode plot response: %v", err)
+			return false
+		}
+		if r == nil {
+			return false
+		}
+
+		// older harvesters don't send their hostname in the headers
+		r.Protocol = protocol
+		if r.Protocol.Hostname == "" {
+			r.Protocol.Hostname = r.Hostname
+		}
+		checkProtocol(r.Protocol)
+		resp = r
+		return true
+	})
+	switch {
+	case err != nil:
 		return nil, err
+	case resp != nil:
+		return resp, nil
+	case len(declined.Declines) > 0:
+		return nil, declined
+	default:
+		return nil, nats.ErrTimeout
 	}
-	return resp, nil
 }
 
-func (d *NatsPlotterClient) PlotLocate(plot *types.PlotLocateRequest) (*types.PlotLocateResponse, error) {
+// PlotLocate returns the first harvester which has the plot. If a harvester
+// only has a plot with the same name but a different size, a *types.TransferError
+// with the size mismatch reason is returned. If none have it, nats.ErrTimeout or
+// nats.ErrNoResponders is returned.
+func (d *NatsPlotterClient) PlotLocate(ctx context.Context, plot *types.PlotLocateRequest) (*types.PlotLocateResponse, error) {
 	var resp *types.PlotLocateResponse
-	if err := request(d.client, subjPlotLocate, plot, &resp, time.Second*1); err != nil {
+	var mismatch error
+	err := requestMany(ctx, d.client, subject(subjPlotLocate), plot, d.timeouts.Locate, func(msg *nats.Msg) bool {
+		var r *types.PlotLocateResponse
+		if err := decodeResponse(msg, &r); err != nil {
+			mismatch = err
+			return false
+		}
+		resp = r
+		return resp != nil
+	})
+	switch {
+	case err != nil:
+		return nil, err
+	case resp != nil:
+		return resp, nil
+	case mismatch != nil:
+		return nil, mismatch
+	default:
+		return nil, nats.ErrTimeout
+	}
+}
+
+// PlotLocateAll returns every harvester which has the plot, collecting
+// responses for the specified amount of time.
+func (d *NatsPlotterClient) PlotLocateAll(ctx context.Context, plot *types.PlotLocateRequest, wait time.Duration) ([]*types.PlotLocateResponse, error) {
+	responses := make([]*types.PlotLocateResponse, 0)
+	err := requestMany(ctx, d.client, subject(subjPlotLocate), plot, wait, func(msg *nats.Msg) bool {
+		var resp *types.PlotLocateResponse
+		if err := decodeResponse(msg, &resp); err == nil && resp != nil {
+			responses = append(responses, resp)
+		}
+		return false
+	})
+	if err == nats.ErrNoResponders {
+		return responses, nil
+	}
+	return responses, err
+}
+
+// locateBatchSize is the most plots to ask about in a single batched locate
+// request, keeping each well under the max payload.
+const locateBatchSize = 1000
+
+// PlotLocateBatch asks the harvesters which of the plots they have, collecting
+// responses for the locate timeout. Larger batches are split across multiple
+// requests. Harvesters which predate batched requests don't respond.
+func (d *NatsPlotterClient) PlotLocateBatch(ctx context.Context, plots []*types.PlotLocateRequest) ([]*types.PlotLocateBatchResponse, error) {
+	responses := make([]*types.PlotLocateBatchResponse, 0)
+	for start := 0; start < len(plots); start += locateBatchSize {
+		req := &types.PlotLocateBatchRequest{
+			Plots: plots[start:min(start+locateBatchSize, len(plots))],
+		}
+		err := requestMany(ctx, d.client, subject(subjPlotLocateBatch), req, d.timeouts.Locate, func(msg *nats.Msg) bool {
+			var resp *types.PlotLocateBatchResponse
+			if err := decodeResponse(msg, &resp); err == nil && resp != nil {
+				responses = append(responses, resp)
+			}
+			return false
+		})
+		if err == nats.ErrNoResponders {
+			continue
+		}
+		if err != nil {
+			return responses, err
+		}
+	}
+	return responses, nil
+}
+
+func (d *NatsPlotterClient) PlotPull(ctx context.Context, hostname string, plot *types.PlotPullRequest) (*types.PlotPullResponse, error) {
+	var resp *types.PlotPullResponse
+	if err := request(ctx, d.client, subject(subjPlotPull, hostname), plot, &resp, d.timeouts.Request); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (d *NatsPlotterClient) PlotMove(ctx context.Context, hostname string, plot *types.PlotMoveRequest, timeout time.Duration) (*types.PlotMoveResponse, error) {
+	var resp *types.PlotMoveResponse
+	if err := request(ctx, d.client, subject(subjPlotMove, hostname), plot, &resp, timeout); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (d *NatsPlotterClient) PlotStreamStart(ctx context.Context, hostname string, plot *types.PlotStreamRequest) (*types.PlotStreamResponse, error) {
+	var resp *types.PlotStreamResponse
+	if err := request(ctx, d.client, subject(subjPlotStream, hostname), plot, &resp, d.timeouts.Request); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// NatsPlotStream is used to send the chunks of a plot to a harvester over NATS
+// after the stream has been started. Chunks are published without waiting for
+// a reply, so multiple can be in flight, and their acknowledgements are read
+// back in order with NextAck.
+type NatsPlotStream struct {
+	client   *nats.Conn
+	subject  string
+	inbox    string
+	acks     chan *nats.Msg
+	sub      *nats.Subscription
+	timeouts Timeouts
+}
+
+func (d *NatsPlotterClient) NewPlotStream(subject string) (*NatsPlotStream, error) {
+	s := &NatsPlotStream{
+		client:   d.client,
+		subject:  subject,
+		inbox:    d.client.NewRespInbox(),
+		acks:     make(chan *nats.Msg, 1024),
+		timeouts: d.timeouts,
+	}
+
+	sub, err := d.client.ChanSubscribe(s.inbox, s.acks)
+	if err != nil {
+		return nil, err
+	}
+	s.sub = sub
+	return s, nil
+}
+
+func (s *NatsPlotStream) SendChunk(offset uint64, data []byte) error {
+	msg := newMsg(s.subject, data)
+	msg.Reply = s.inbox
+	msg.Header.Set(hdrStreamOp, streamOpChunk)
+	msg.Header.Set(hdrStreamOffset, strconv.FormatUint(offset, 10))
+	return s.client.PublishMsg(msg)
+}
+
+func (s *NatsPlotStream) NextAck(ctx context.Context, timeout time.Duration) (*types.PlotStreamAck, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+
+	case msg := <-s.acks:
+		var resp *types.PlotStreamAck
+		if err := decodeResponse(msg, &resp); err != nil {
+			return nil, err
+		}
+		return resp, nil
+
+	case <-time.After(timeout):
+		return nil, nats.ErrTimeout
+	}
+}
+
+func (s *NatsPlotStream) Commit(ctx context.Context, commit *types.PlotStreamCommit, timeout time.Duration) (*types.PlotStreamResult, error) {
+	data, err := json.Marshal(commit)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := newRequest(s.subject, data, timeout)
+	msg.Header.Set(hdrStreamOp, streamOpCommit)
+
+	reply, err := s.requestMsg(ctx, msg, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *types.PlotStreamResult
+	if err := decodeResponse(reply, &resp); err != nil {
 		return nil, err
 	}
 	return resp, nil
 }
+
+func (s *NatsPlotStream) Abort(ctx context.Context) error {
+	msg := newRequest(s.subject, nil, s.timeouts.Request)
+	msg.Header.Set(hdrStreamOp, streamOpAbort)
+
+	reply, err := s.requestMsg(ctx, msg, s.timeouts.Request)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(reply, nil)
+}
+
+// requestMsg sends a message on the stream and waits for the reply.
+func (s *NatsPlotStream) requestMsg(ctx context.Context, msg *nats.Msg, timeout time.Duration) (*nats.Msg, error) {
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	reply, err := s.client.RequestMsgWithContext(tctx, msg)
+	return reply, timeoutError(ctx, err)
+}
+
+func (s *NatsPlotStream) Close() error {
+	return s.sub.Unsubscribe()
+}
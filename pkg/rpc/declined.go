@@ -0,0 +1,46 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package rpc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/krobertson/chia-garden/pkg/types"
+)
+
+// DeclinedError is returned when every harvester which responded to a plot
+// request declined it. It lets the plotter tell apart all of the harvesters
+// being full from none of them being online.
+type DeclinedError struct {
+	// Declines holds the reason each harvester gave, keyed by hostname.
+	Declines map[string]*types.TransferError
+}
+
+func (e *DeclinedError) Error() string {
+	hosts := make([]string, 0, len(e.Declines))
+	for host := range e.Declines {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	parts := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		parts = append(parts, fmt.Sprintf("%s: %s", host, e.Declines[host].Reason))
+	}
+	return fmt.Sprintf("declined by %d harvesters (%s)", len(hosts), strings.Join(parts, ", "))
+}
+
+// Transient returns whether any of the harvesters declined for a reason which
+// is likely to clear up soon, such as being busy with other transfers, so the
+// plot is worth offering again shortly.
+func (e *DeclinedError) Transient() bool {
+	for _, terr := range e.Declines {
+		switch terr.Reason {
+		case types.ReasonBusy, types.ReasonMaxTransfers, types.ReasonDraining:
+			return true
+		}
+	}
+	return false
+}
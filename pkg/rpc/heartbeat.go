@@ -0,0 +1,80 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/krobertson/chia-garden/pkg/types"
+	"github.com/nats-io/nats.go"
+)
+
+// PublishHeartbeat announces the harvester's current state to any plotters and
+// status commands watching for them.
+func PublishHeartbeat(client *nats.Conn, hb *types.Heartbeat) {
+	data, err := json.Marshal(hb)
+	if err != nil {
+		log.Printf("Failed to generate heartbeat message: %v", err)
+		return
+	}
+
+	if err := client.PublishMsg(newMsg(subject(subjHarvesterHeartbeat), data)); err != nil {
+		log.Printf("Failed to publish heartbeat message: %v", err)
+	}
+}
+
+// SubscribeHeartbeats calls the handler for each heartbeat published by the
+// harvesters.
+func SubscribeHeartbeats(client *nats.Conn, handler func(*types.Heartbeat)) (*nats.Subscription, error) {
+	return client.Subscribe(subject(subjHarvesterHeartbeat), func(msg *nats.Msg) {
+		if hb := decodeHeartbeat(msg); hb != nil {
+			handler(hb)
+		}
+	})
+}
+
+// SubscribeHeartbeatRequests responds to requests for the harvester's state
+// with the heartbeat returned by the handler, so the current harvesters can be
+// found without waiting for their next heartbeat.
+func SubscribeHeartbeatRequests(client *nats.Conn, handler func() *types.Heartbeat) (*nats.Subscription, error) {
+	return client.Subscribe(subject(subjHarvesterStatus), func(msg *nats.Msg) {
+		checkMsg(msg)
+		respond(client, msg, handler(), nil)
+	})
+}
+
+// RequestHeartbeats asks all of the harvesters for their current state,
+// collecting responses for the specified amount of time.
+func RequestHeartbeats(ctx context.Context, client *nats.Conn, wait time.Duration) ([]*types.Heartbeat, error) {
+	heartbeats := make([]*types.Heartbeat, 0)
+	err := requestMany(ctx, client, subject(subjHarvesterStatus), struct{}{}, wait, func(msg *nats.Msg) bool {
+		var hb *types.Heartbeat
+		if err := decodeResponse(msg, &hb); err != nil || hb == nil {
+			return false
+		}
+		hb.Protocol = protocolOf(msg)
+		heartbeats = append(heartbeats, hb)
+		return false
+	})
+	if err == nats.ErrNoResponders {
+		return heartbeats, nil
+	}
+	return heartbeats, err
+}
+
+// decodeHeartbeat returns the heartbeat in the message, or nil if it couldn't
+// be decoded.
+func decodeHeartbeat(msg *nats.Msg) *types.Heartbeat {
+	checkMsg(msg)
+
+	var hb *types.Heartbeat
+	if err := json.Unmarshal(msg.Data, &hb); err != nil {
+		log.Println("Failed to unmarshal heartbeat")
+		return nil
+	}
+	hb.Protocol = protocolOf(msg)
+	return hb
+}
@@ -3,33 +3,67 @@
 package rpc
 
 import (
+	"context"
 	"encoding/json"
 	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/krobertson/chia-garden/pkg/types"
 	"github.com/nats-io/nats.go"
 )
 
 type NatsHarvesterListener struct {
-	client  *nats.Conn
-	handler Harvester
+	ctx          context.Context
+	client       *nats.Conn
+	hostname     string
+	handler      Harvester
+	streams      map[string]*nats.Subscription
+	streamsMutex sync.Mutex
 }
 
-func NewNatsHarvesterListener(client *nats.Conn, handler Harvester) (*NatsHarvesterListener, error) {
+// NewNatsHarvesterListener subscribes the handler to the harvester's requests.
+// Requests still being handled are cancelled once the context is done.
+func NewNatsHarvesterListener(ctx context.Context, client *nats.Conn, hostname string, handler Harvester) (*NatsHarvesterListener, error) {
 	w := &NatsHarvesterListener{
-		client:  client,
-		handler: handler,
+		ctx:      ctx,
+		client:   client,
+		hostname: hostname,
+		handler:  handler,
+		streams:  make(map[string]*nats.Subscription),
 	}
 	return w, w.RegisterHandlers()
 }
 
 func (w *NatsHarvesterListener) RegisterHandlers() error {
-	_, err := w.client.Subscribe(subjPlotReady, w.handlerPlotReady)
+	_, err := w.client.Subscribe(subject(subjPlotReady), w.handlerPlotReady)
 	if err != nil {
 		return err
 	}
 
-	_, err = w.client.Subscribe(subjPlotLocate, w.handlerPlotLocate)
+	_, err = w.client.Subscribe(subject(subjPlotLocate), w.handlerPlotLocate)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.client.Subscribe(subject(subjPlotLocateBatch), w.handlerPlotLocateBatch)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.client.Subscribe(subject(subjPlotPull, w.hostname), w.handlerPlotPull)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.client.Subscribe(subject(subjPlotMove, w.hostname), w.handlerPlotMove)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.client.Subscribe(subject(subjPlotStream, w.hostname), w.handlerPlotStream)
 	if err != nil {
 		return err
 	}
@@ -38,62 +72,215 @@ func (w *NatsHarvesterListener) RegisterHandlers() error {
 }
 
 func (d *NatsHarvesterListener) handlerPlotReady(msg *nats.Msg) {
+	checkMsg(msg)
+
 	var req *types.PlotRequest
 	if err := json.Unmarshal(msg.Data, &req); err != nil {
 		log.Println("Failed to unmarshal rig")
 		return
 	}
 
-	resp, err := d.handler.PlotReady(req)
-	if resp != nil || err != nil {
-		d.respond(msg, resp, err)
+	ctx, cancel := requestContext(d.ctx, msg)
+	defer cancel()
+
+	resp, err := d.handler.PlotReady(ctx, req)
+	switch {
+	case ctx.Err() != nil:
+		// the plotter has given up, so there is nobody to respond to
+	case err != nil:
+		d.decline(msg, err)
+	case resp != nil:
+		d.respond(msg, resp, nil)
 	}
 }
 
 func (d *NatsHarvesterListener) handlerPlotLocate(msg *nats.Msg) {
+	checkMsg(msg)
+
 	var req *types.PlotLocateRequest
 	if err := json.Unmarshal(msg.Data, &req); err != nil {
 		log.Println("Failed to unmarshal rig")
 		return
 	}
 
-	resp, err := d.handler.PlotLocate(req)
-	if resp != nil || err != nil {
-		d.respond(msg, resp, err)
+	ctx, cancel := requestContext(d.ctx, msg)
+	defer cancel()
+
+	resp, err := d.handler.PlotLocate(ctx, req)
+	switch {
+	case ctx.Err() != nil:
+		// the plotter has given up, so there is nobody to respond to
+	case err != nil:
+		d.decline(msg, err)
+	case resp != nil:
+		d.respond(msg, resp, nil)
 	}
 }
 
-func (d *NatsHarvesterListener) respond(msg *nats.Msg, v interface{}, err error) {
-	// if there is no reply subject, just bail, we have no option
-	if msg.Reply == "" {
-		if err != nil {
-			log.Printf("Error returned from call: %v", err)
-		}
+func (d *NatsHarvesterListener) handlerPlotLocateBatch(msg *nats.Msg) {
+	checkMsg(msg)
+
+	var req *types.PlotLocateBatchRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		log.Println("Failed to unmarshal rig")
 		return
 	}
 
-	resp := &natsResponse{}
-	if err != nil {
-		s := err.Error()
-		resp.Error = &s
-	} else {
-		data, err := json.Marshal(v)
-		if err != nil {
-			s := err.Error()
-			resp.Error = &s
-		} else {
-			resp.Result = data
-		}
+	ctx, cancel := requestContext(d.ctx, msg)
+	defer cancel()
+
+	// only respond if we have any of the plots
+	resp, err := d.handler.PlotLocateBatch(ctx, req)
+	switch {
+	case ctx.Err() != nil:
+		// the plotter has given up, so there is nobody to respond to
+	case err != nil:
+		log.Printf("Failed to locate batch of plots: %v", err)
+	case resp != nil:
+		d.respond(msg, resp, nil)
+	}
+}
+
+func (d *NatsHarvesterListener) handlerPlotPull(msg *nats.Msg) {
+	checkMsg(msg)
+
+	var req *types.PlotPullRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		log.Println("Failed to unmarshal rig")
+		return
 	}
 
-	data, err := json.Marshal(resp)
-	if err != nil {
-		log.Printf("Failed to generate reply message: %v", err)
+	ctx, cancel := requestContext(d.ctx, msg)
+	defer cancel()
+
+	resp, err := d.handler.PlotPull(ctx, req)
+	d.respond(msg, resp, err)
+}
+
+func (d *NatsHarvesterListener) handlerPlotMove(msg *nats.Msg) {
+	checkMsg(msg)
+
+	var req *types.PlotMoveRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		log.Println("Failed to unmarshal rig")
 		return
 	}
 
-	if err = d.client.Publish(msg.Reply, data); err != nil {
-		log.Printf("Failed to publish reply message: %v", err)
+	// moves can take a while if they need to copy, so don't block other
+	// requests
+	ctx, cancel := requestContext(d.ctx, msg)
+	go func() {
+		defer cancel()
+		resp, err := d.handler.PlotMove(ctx, req)
+		d.respond(msg, resp, err)
+	}()
+}
+
+func (d *NatsHarvesterListener) handlerPlotStream(msg *nats.Msg) {
+	checkMsg(msg)
+
+	var req *types.PlotStreamRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		log.Println("Failed to unmarshal rig")
 		return
 	}
+
+	ctx, cancel := requestContext(d.ctx, msg)
+	defer cancel()
+
+	resp, err := d.handler.PlotStreamStart(ctx, req)
+	if err == nil {
+		resp.Subject, err = d.streamSubscribe(req)
+	}
+	d.respond(msg, resp, err)
+}
+
+// streamSubscribe will subscribe to a unique subject for the chunks of a plot
+// being streamed over NATS. Each stream gets its own subscription so that
+// concurrent streams are processed independently, while chunks within one are
+// processed in order.
+func (d *NatsHarvesterListener) streamSubscribe(req *types.PlotStreamRequest) (string, error) {
+	d.streamsMutex.Lock()
+	defer d.streamsMutex.Unlock()
+
+	key := filepath.Join(req.Store, req.Name)
+	if sub, exists := d.streams[key]; exists {
+		return sub.Subject, nil
+	}
+
+	subj := subject(subjPlotStream, d.hostname, strings.TrimPrefix(nats.NewInbox(), nats.InboxPrefix))
+	sub, err := d.client.Subscribe(subj, func(msg *nats.Msg) {
+		d.handlerPlotStreamMsg(key, req, msg)
+	})
+	if err != nil {
+		return "", err
+	}
+	d.streams[key] = sub
+	return subj, nil
+}
+
+func (d *NatsHarvesterListener) streamUnsubscribe(key string) {
+	d.streamsMutex.Lock()
+	defer d.streamsMutex.Unlock()
+
+	if sub, exists := d.streams[key]; exists {
+		sub.Unsubscribe()
+		delete(d.streams, key)
+	}
+}
+
+func (d *NatsHarvesterListener) handlerPlotStreamMsg(key string, req *types.PlotStreamRequest, msg *nats.Msg) {
+	switch msg.Header.Get(hdrStreamOp) {
+	case streamOpChunk:
+		offset, err := strconv.ParseUint(msg.Header.Get(hdrStreamOffset), 10, 64)
+		if err != nil {
+			log.Printf("Invalid offset on stream chunk: %v", err)
+			return
+		}
+
+		resp, err := d.handler.PlotStreamChunk(d.ctx, &types.PlotStreamChunk{
+			Name:   req.Name,
+			Store:  req.Store,
+			Offset: offset,
+			Data:   msg.Data,
+		})
+		d.respond(msg, resp, err)
+
+		// an error means the stream is no longer usable
+		if err != nil {
+			d.streamUnsubscribe(key)
+		}
+
+	case streamOpCommit:
+		var commit *types.PlotStreamCommit
+		if err := json.Unmarshal(msg.Data, &commit); err != nil {
+			log.Println("Failed to unmarshal rig")
+			return
+		}
+
+		ctx, cancel := requestContext(d.ctx, msg)
+		defer cancel()
+
+		resp, err := d.handler.PlotStreamCommit(ctx, commit)
+		d.respond(msg, resp, err)
+		d.streamUnsubscribe(key)
+
+	case streamOpAbort:
+		err := d.handler.PlotStreamAbort(d.ctx, req)
+		d.respond(msg, nil, err)
+		d.streamUnsubscribe(key)
+	}
+}
+
+func (d *NatsHarvesterListener) respond(msg *nats.Msg, v interface{}, err error) {
+	respond(d.client, msg, v, err)
+}
+
+// decline responds with the error to a request sent to all harvesters. It is
+// only sent to plotters which support explicit declines, since older ones use
+// the first response they receive and expect only accepting harvesters reply.
+func (d *NatsHarvesterListener) decline(msg *nats.Msg, err error) {
+	if protocolOf(msg).Has(types.CapDecline) {
+		d.respond(msg, nil, err)
+	}
 }
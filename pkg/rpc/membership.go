@@ -0,0 +1,169 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package rpc
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/krobertson/chia-garden/pkg/types"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// DefaultHeartbeatInterval is used for harvesters which don't say how
+	// often they send heartbeats.
+	DefaultHeartbeatInterval = 15 * time.Second
+
+	// silentHeartbeats is how many heartbeats a harvester can miss before it
+	// is considered to have gone silent.
+	silentHeartbeats = 3
+)
+
+// Member is a harvester known to the membership table, along with its latest
+// heartbeat.
+type Member struct {
+	*types.Heartbeat
+	LastSeen time.Time
+	Silent   bool
+}
+
+// Membership tracks the harvesters on the bus based on their heartbeats, and
+// detects those which have gone silent.
+type Membership struct {
+	client     *nats.Conn
+	logChanges bool
+	members    map[string]*Member
+	mutex      sync.Mutex
+	sub        *nats.Subscription
+	done       chan struct{}
+}
+
+// WatchMembership subscribes to the harvesters' heartbeats and starts checking
+// for those which go silent. If logChanges is set, harvesters joining, draining,
+// going silent and coming back are logged.
+func WatchMembership(client *nats.Conn, logChanges bool) (*Membership, error) {
+	m := &Membership{
+		client:     client,
+		logChanges: logChanges,
+		members:    make(map[string]*Member),
+		done:       make(chan struct{}),
+	}
+
+	sub, err := SubscribeHeartbeats(client, m.record)
+	if err != nil {
+		return nil, err
+	}
+	m.sub = sub
+
+	go m.run()
+	return m, nil
+}
+
+// Refresh asks the harvesters for their current state rather than waiting for
+// their next heartbeats, collecting responses for the specified amount of time.
+func (m *Membership) Refresh(ctx context.Context, wait time.Duration) error {
+	heartbeats, err := RequestHeartbeats(ctx, m.client, wait)
+	for _, hb := range heartbeats {
+		m.record(hb)
+	}
+	return err
+}
+
+// Close stops watching for heartbeats.
+func (m *Membership) Close() {
+	m.sub.Unsubscribe()
+	close(m.done)
+}
+
+// List returns a copy of all of the known harvesters, sorted by hostname.
+func (m *Membership) List() []*Member {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	list := make([]*Member, 0, len(m.members))
+	for _, member := range m.members {
+		c := *member
+		list = append(list, &c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Hostname < list[j].Hostname
+	})
+	return list
+}
+
+// Online returns the number of harvesters which haven't gone silent.
+func (m *Membership) Online() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	n := 0
+	for _, member := range m.members {
+		if !member.Silent {
+			n++
+		}
+	}
+	return n
+}
+
+// record updates the table with a heartbeat.
+func (m *Membership) record(hb *types.Heartbeat) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	member, known := m.members[hb.Hostname]
+	switch {
+	case !known:
+		m.logf("Harvester %s joined with %d paths (protocol version %d)", hb.Hostname, hb.Paths, hb.Protocol.Version)
+	case member.Silent:
+		m.logf("Harvester %s is back after %s", hb.Hostname, time.Since(member.LastSeen).Round(time.Second))
+	case hb.Draining && !member.Draining:
+		m.logf("Harvester %s is draining and won't accept new plots", hb.Hostname)
+	}
+
+	m.members[hb.Hostname] = &Member{
+		Heartbeat: hb,
+		LastSeen:  time.Now(),
+	}
+}
+
+// run periodically marks harvesters which have missed their heartbeats as
+// silent.
+func (m *Membership) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+
+		m.mutex.Lock()
+		for _, member := range m.members {
+			if member.Silent {
+				continue
+			}
+			interval := member.Interval
+			if interval <= 0 {
+				interval = DefaultHeartbeatInterval
+			}
+			if time.Since(member.LastSeen) > silentHeartbeats*interval {
+				member.Silent = true
+				m.logf("Harvester %s has gone silent, last heard from %s ago",
+					member.Hostname, time.Since(member.LastSeen).Round(time.Second))
+			}
+		}
+		m.mutex.Unlock()
+	}
+}
+
+func (m *Membership) logf(format string, args ...any) {
+	if m.logChanges {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package rpc
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/krobertson/chia-garden/pkg/types"
+	"github.com/nats-io/nats.go"
+)
+
+func PublishTransferProgress(client *nats.Conn, progress *types.TransferProgress) {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		log.Printf("Failed to generate progress message: %v", err)
+		return
+	}
+
+	if err := client.PublishMsg(newMsg(subject(subjTransferProgress), data)); err != nil {
+		log.Printf("Failed to publish progress message: %v", err)
+	}
+}
+
+func SubscribeTransferProgress(client *nats.Conn, handler func(*types.TransferProgress)) (*nats.Subscription, error) {
+	return client.Subscribe(subject(subjTransferProgress), func(msg *nats.Msg) {
+		var progress *types.TransferProgress
+		if err := json.Unmarshal(msg.Data, &progress); err != nil {
+			log.Println("Failed to unmarshal rig")
+			return
+		}
+		handler(progress)
+	})
+}
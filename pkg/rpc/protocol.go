@@ -0,0 +1,109 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krobertson/chia-garden/pkg/types"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	hdrProtocol     = "Garden-Protocol"
+	hdrCapabilities = "Garden-Capabilities"
+	hdrHostname     = "Garden-Hostname"
+	hdrTimeout      = "Garden-Timeout"
+)
+
+var (
+	systemHostname, _ = os.Hostname()
+
+	// outdated records the hosts which have already been logged as running an
+	// older protocol version, so they are only logged once.
+	outdated sync.Map
+)
+
+// newMsg creates a message for the subject with the protocol headers set.
+func newMsg(subj string, data []byte) *nats.Msg {
+	msg := nats.NewMsg(subj)
+	setProtocol(msg)
+	msg.Data = data
+	return msg
+}
+
+// newRequest creates a request message for the subject, including how long the
+// requester will wait for a response, so the responder can give up on requests
+// which have been abandoned.
+func newRequest(subj string, data []byte, timeout time.Duration) *nats.Msg {
+	msg := newMsg(subj, data)
+	msg.Header.Set(hdrTimeout, strconv.FormatInt(timeout.Milliseconds(), 10))
+	return msg
+}
+
+// requestContext returns a context for handling the request, which is done once
+// the requester has stopped waiting for a response. Requests from older hosts
+// don't say how long they'll wait, so only the parent context applies.
+func requestContext(parent context.Context, msg *nats.Msg) (context.Context, context.CancelFunc) {
+	ms, err := strconv.ParseInt(msg.Header.Get(hdrTimeout), 10, 64)
+	if err != nil || ms <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, time.Duration(ms)*time.Millisecond)
+}
+
+// setProtocol sets the headers describing the protocol of this host.
+func setProtocol(msg *nats.Msg) {
+	msg.Header.Set(hdrProtocol, strconv.Itoa(types.ProtocolVersion))
+	msg.Header.Set(hdrCapabilities, strings.Join(types.Capabilities, ","))
+	msg.Header.Set(hdrHostname, systemHostname)
+}
+
+// protocolOf returns the protocol of the host which sent the message. Messages
+// without the headers are from hosts which predate versioning.
+func protocolOf(msg *nats.Msg) *types.Protocol {
+	p := &types.Protocol{Version: 1}
+	if msg.Header == nil {
+		return p
+	}
+
+	p.Hostname = msg.Header.Get(hdrHostname)
+	if v, err := strconv.Atoi(msg.Header.Get(hdrProtocol)); err == nil {
+		p.Version = v
+	}
+	if caps := msg.Header.Get(hdrCapabilities); caps != "" {
+		p.Capabilities = strings.Split(caps, ",")
+	}
+	return p
+}
+
+// checkProtocol logs hosts running an older protocol version once, since some
+// features won't be used with them. Hosts which predate versioning are still
+// compatible, as features are only used when both sides advertise them.
+func checkProtocol(p *types.Protocol) {
+	if p.Version >= types.ProtocolVersion {
+		return
+	}
+
+	host := p.Hostname
+	if host == "" {
+		host = "(unknown)"
+	}
+	key := fmt.Sprintf("%s|%d", host, p.Version)
+	if _, logged := outdated.LoadOrStore(key, true); !logged {
+		log.Printf("Host %s is running outdated protocol version %d (current is %d), features it doesn't support won't be used",
+			host, p.Version, types.ProtocolVersion)
+	}
+}
+
+// checkMsg checks the protocol of the host which sent the message.
+func checkMsg(msg *nats.Msg) {
+	checkProtocol(protocolOf(msg))
+}
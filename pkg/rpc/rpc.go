@@ -3,10 +3,22 @@
 package rpc
 
 import (
+	"context"
+
 	"github.com/krobertson/chia-garden/pkg/types"
 )
 
+// Harvester handles the requests sent to a harvester. The context is done once
+// the requester has stopped waiting for a response, or the listener is shutting
+// down.
 type Harvester interface {
-	PlotReady(*types.PlotRequest) (*types.PlotResponse, error)
-	PlotLocate(*types.PlotLocateRequest) (*types.PlotLocateResponse, error)
+	PlotReady(context.Context, *types.PlotRequest) (*types.PlotResponse, error)
+	PlotLocate(context.Context, *types.PlotLocateRequest) (*types.PlotLocateResponse, error)
+	PlotLocateBatch(context.Context, *types.PlotLocateBatchRequest) (*types.PlotLocateBatchResponse, error)
+	PlotPull(context.Context, *types.PlotPullRequest) (*types.PlotPullResponse, error)
+	PlotMove(context.Context, *types.PlotMoveRequest) (*types.PlotMoveResponse, error)
+	PlotStreamStart(context.Context, *types.PlotStreamRequest) (*types.PlotStreamResponse, error)
+	PlotStreamChunk(context.Context, *types.PlotStreamChunk) (*types.PlotStreamAck, error)
+	PlotStreamCommit(context.Context, *types.PlotStreamCommit) (*types.PlotStreamResult, error)
+	PlotStreamAbort(context.Context, *types.PlotStreamRequest) error
 }
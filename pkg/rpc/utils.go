@@ -3,40 +3,165 @@
 package rpc
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
+	"strings"
 	"time"
 
+	"github.com/krobertson/chia-garden/pkg/types"
+
 	"github.com/nats-io/nats.go"
 )
 
 const (
-	subjPlotReady  = "b4s.plot.ready"
-	subjPlotLocate = "b4s.plot.locate"
+	// DefaultSubjectPrefix is the prefix of the subjects used when another
+	// isn't configured.
+	DefaultSubjectPrefix = "b4s"
+
+	subjPlotReady       = "plot.ready"
+	subjPlotLocate      = "plot.locate"
+	subjPlotLocateBatch = "plot.locate.batch"
+	subjPlotPull        = "plot.pull"
+	subjPlotMove        = "plot.move"
+	subjPlotStream      = "plot.stream"
+
+	subjHarvesterHeartbeat = "harvester.heartbeat"
+	subjHarvesterStatus    = "harvester.status"
+
+	subjTransferProgress = "transfer.progress"
+	subjTransferCancel   = "transfer.cancel"
+)
+
+// subjectPrefix is prepended to all of the subjects, so that separate farms or
+// environments can share a NATS server without seeing each other's requests.
+var subjectPrefix = DefaultSubjectPrefix
+
+// SetSubjectPrefix sets the prefix of all of the subjects. It must be called
+// before any requests are made or subscriptions created.
+func SetSubjectPrefix(prefix string) error {
+	if prefix == "" || strings.ContainsAny(prefix, "*> \t") ||
+		strings.HasPrefix(prefix, ".") || strings.HasSuffix(prefix, ".") || strings.Contains(prefix, "..") {
+		return fmt.Errorf("invalid subject prefix %q", prefix)
+	}
+	subjectPrefix = prefix
+	return nil
+}
+
+// subject returns the full subject for the name, along with any additional
+// tokens such as a hostname.
+func subject(name string, tokens ...string) string {
+	return strings.Join(append([]string{subjectPrefix, name}, tokens...), ".")
+}
+
+const (
+	hdrStreamOp     = "Garden-Stream-Op"
+	hdrStreamOffset = "Garden-Stream-Offset"
+
+	streamOpChunk  = "chunk"
+	streamOpCommit = "commit"
+	streamOpAbort  = "abort"
 )
 
 type natsResponse struct {
 	Result json.RawMessage `json:"result"`
 	Error  *string         `json:"error"`
+	Code   string          `json:"code,omitempty"`
+}
+
+func request(ctx context.Context, client *nats.Conn, subj string, in interface{}, out interface{}, timeout time.Duration) error {
+	msg, err := requestMsg(ctx, client, subj, in, timeout)
+	if err != nil {
+		return err
+	}
+	checkMsg(msg)
+
+	return decodeResponse(msg, out)
+}
+
+// requestMsg sends a request with the protocol headers and returns the reply.
+// The caller is responsible for checking the responding host is compatible.
+func requestMsg(ctx context.Context, client *nats.Conn, subj string, in interface{}, timeout time.Duration) (*nats.Msg, error) {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	msg, err := client.RequestMsgWithContext(tctx, newRequest(subj, data, timeout))
+	return msg, timeoutError(ctx, err)
 }
 
-func request(client *nats.Conn, subj string, in interface{}, out interface{}, timeout time.Duration) error {
+// requestMany publishes a request which multiple hosts may respond to, and
+// calls fn with each response received within the wait time, stopping early if
+// fn returns true. Responses from incompatible hosts are skipped.
+func requestMany(ctx context.Context, client *nats.Conn, subj string, in interface{}, wait time.Duration, fn func(*nats.Msg) bool) error {
 	data, err := json.Marshal(in)
 	if err != nil {
 		return err
 	}
 
-	msg, err := client.Request(subj, data, timeout)
+	inbox := client.NewInbox()
+	sub, err := client.SubscribeSync(inbox)
 	if err != nil {
 		return err
 	}
+	defer sub.Unsubscribe()
 
+	req := newRequest(subj, data, wait)
+	req.Reply = inbox
+	if err := client.PublishMsg(req); err != nil {
+		return err
+	}
+
+	wctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	for {
+		msg, err := sub.NextMsgWithContext(wctx)
+		if err != nil {
+			// reaching the end of the wait is the expected way to finish
+			if err = timeoutError(ctx, err); err == nats.ErrTimeout {
+				return nil
+			}
+			return err
+		}
+		// the server replies with an empty 503 status when nothing is
+		// subscribed to the subject
+		if len(msg.Data) == 0 && msg.Header.Get("Status") == "503" {
+			return nats.ErrNoResponders
+		}
+		checkMsg(msg)
+		if fn(msg) {
+			return nil
+		}
+	}
+}
+
+// timeoutError converts a request's deadline being exceeded into
+// nats.ErrTimeout, so callers can tell it apart from the parent context being
+// cancelled, such as when shutting down.
+func timeoutError(ctx context.Context, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return nats.ErrTimeout
+	}
+	return err
+}
+
+func decodeResponse(msg *nats.Msg, out interface{}) error {
 	var resp *natsResponse
 	if err := json.Unmarshal(msg.Data, &resp); err != nil {
 		return err
 	}
 
 	if resp.Error != nil {
+		if resp.Code != "" {
+			return &types.TransferError{Reason: resp.Code, Message: *resp.Error}
+		}
 		return errors.New(*resp.Error)
 	}
 
@@ -45,3 +170,51 @@ func request(client *nats.Conn, subj string, in interface{}, out interface{}, ti
 	}
 	return nil
 }
+
+func respond(client *nats.Conn, msg *nats.Msg, v interface{}, err error) {
+	// if there is no reply subject, just bail, we have no option
+	if msg.Reply == "" {
+		if err != nil {
+			log.Printf("Error returned from call: %v", err)
+		}
+		return
+	}
+
+	resp := &natsResponse{}
+	if err != nil {
+		s := err.Error()
+		resp.Error = &s
+		resp.Code = errorCode(err)
+	} else {
+		data, err := json.Marshal(v)
+		if err != nil {
+			s := err.Error()
+			resp.Error = &s
+		} else {
+			resp.Result = data
+		}
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Failed to generate reply message: %v", err)
+		return
+	}
+
+	if err = client.PublishMsg(newMsg(msg.Reply, data)); err != nil {
+		log.Printf("Failed to publish reply message: %v", err)
+		return
+	}
+}
+
+// errorCode returns the reason code sent along with an error, so the requesting
+// host can tell why a request failed without parsing the message.
+func errorCode(err error) string {
+	var terr *types.TransferError
+	switch {
+	case errors.As(err, &terr):
+		return terr.Reason
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package transfer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/krobertson/chia-garden/pkg/types"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Progress tracks the number of bytes transferred for a single plot.
+type Progress struct {
+	name    string
+	peer    string
+	size    int64
+	bytes   atomic.Int64
+	started time.Time
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+}
+
+// Add records n more bytes as transferred.
+func (p *Progress) Add(n int64) {
+	p.bytes.Add(n)
+}
+
+// Set records the total bytes transferred, such as when a transfer is resumed
+// or rewound.
+func (p *Progress) Set(n int64) {
+	p.bytes.Store(n)
+}
+
+// Context returns a context which is done once the transfer finishes. If the
+// transfer is cancelled, its cause will be ErrCancelled.
+func (p *Progress) Context() context.Context {
+	return p.ctx
+}
+
+// Cancelled returns the cancellation error if the transfer has been cancelled,
+// and otherwise nil.
+func (p *Progress) Cancelled() error {
+	if cause := context.Cause(p.ctx); errors.Is(cause, ErrCancelled) {
+		return cause
+	}
+	return nil
+}
+
+// Reader wraps the reader to record bytes as they're read. Once the transfer
+// is cancelled, reads will fail with the cancellation error. If the reader is
+// also an io.Closer, the returned reader will be as well.
+func (p *Progress) Reader(r io.Reader) io.Reader {
+	pr := &progressReader{r: r, p: p}
+	if c, ok := r.(io.Closer); ok {
+		return &progressReadCloser{pr, c}
+	}
+	return pr
+}
+
+type progressReader struct {
+	r io.Reader
+	p *Progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	if err := r.p.Cancelled(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(b)
+	r.p.Add(int64(n))
+	return n, err
+}
+
+type progressReadCloser struct {
+	*progressReader
+	io.Closer
+}
+
+// Tracker keeps the set of transfers active within the process so they can be
+// periodically logged and reported.
+type Tracker struct {
+	hostname string
+	role     string
+	active   map[*Progress]struct{}
+	mutex    sync.Mutex
+	publish  func(*types.TransferProgress)
+}
+
+// NewTracker returns a new Tracker for the host and role, which is either
+// plotter or harvester.
+func NewTracker(hostname, role string) *Tracker {
+	return &Tracker{
+		hostname: hostname,
+		role:     role,
+		active:   make(map[*Progress]struct{}),
+	}
+}
+
+// Start begins tracking a new transfer. Finish must be called once it is done.
+func (t *Tracker) Start(name, peer string, size int64) *Progress {
+	p := &Progress{
+		name:    name,
+		peer:    peer,
+		size:    size,
+		started: time.Now(),
+	}
+	p.ctx, p.cancel = context.WithCancelCause(context.Background())
+
+	t.mutex.Lock()
+	t.active[p] = struct{}{}
+	t.mutex.Unlock()
+	return p
+}
+
+// Finish stops tracking the transfer and publishes its final progress.
+func (t *Tracker) Finish(p *Progress) {
+	t.mutex.Lock()
+	delete(t.active, p)
+	publish := t.publish
+	t.mutex.Unlock()
+	p.cancel(context.Canceled)
+
+	if publish != nil {
+		status := t.status(p)
+		status.Finished = true
+		publish(status)
+	}
+}
+
+// Cancel cancels all active transfers of the named plot with the cause, which
+// should wrap ErrCancelled. It returns the number of transfers cancelled.
+func (t *Tracker) Cancel(name string, cause error) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	n := 0
+	for p := range t.active {
+		if p.name == name {
+			p.cancel(cause)
+			n++
+		}
+	}
+	return n
+}
+
+// List returns the current progress of all active transfers.
+func (t *Tracker) List() []*types.TransferProgress {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	list := make([]*types.TransferProgress, 0, len(t.active))
+	for p := range t.active {
+		list = append(list, t.status(p))
+	}
+	return list
+}
+
+// Run will log and publish the progress of all active transfers at the
+// specified interval. It does not return.
+func (t *Tracker) Run(interval time.Duration, publish func(*types.TransferProgress)) {
+	t.mutex.Lock()
+	t.publish = publish
+	t.mutex.Unlock()
+
+	for range time.Tick(interval) {
+		for _, status := range t.List() {
+			log.Printf("Progress of %s with %s: %s / %s (%d%%), %s/sec, ETA %s",
+				status.Name, status.Peer, humanize.IBytes(status.Bytes), humanize.IBytes(status.Size),
+				100*status.Bytes/max(status.Size, 1), humanize.Bytes(status.Rate),
+				(time.Duration(status.Eta) * time.Second).String())
+			if publish != nil {
+				publish(status)
+			}
+		}
+	}
+}
+
+// status generates the current progress for the transfer. The rate is the
+// average since the transfer started.
+func (t *Tracker) status(p *Progress) *types.TransferProgress {
+	bytes := p.bytes.Load()
+	elapsed := time.Since(p.started).Seconds()
+
+	status := &types.TransferProgress{
+		Name:     p.name,
+		Hostname: t.hostname,
+		Role:     t.role,
+		Peer:     p.peer,
+		Size:     uint64(p.size),
+		Bytes:    uint64(bytes),
+		Started:  p.started,
+	}
+	if elapsed > 0 {
+		status.Rate = uint64(float64(bytes) / elapsed)
+	}
+	if status.Rate > 0 {
+		status.Eta = float64(p.size-bytes) / float64(status.Rate)
+	}
+	return status
+}
@@ -0,0 +1,53 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package transfer
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Signer generates and verifies signed tokens for transfer URLs, so that only
+// peers which were handed a URL over NATS can use it. The secret is generated
+// at startup, since only the process which signed a URL needs to verify it.
+type Signer struct {
+	secret []byte
+}
+
+// NewSigner creates a signer with a random secret.
+func NewSigner() (*Signer, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &Signer{secret: secret}, nil
+}
+
+// Query returns the query string for a URL to name, valid for the duration.
+func (s *Signer) Query(name string, valid time.Duration) string {
+	expires := time.Now().Add(valid).Unix()
+	return fmt.Sprintf("expires=%d&sig=%s", expires, s.sign(name, expires))
+}
+
+// Verify checks the query of a URL to name has a valid signature and has not
+// expired.
+func (s *Signer) Verify(name string, query url.Values) bool {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(query.Get("sig")), []byte(s.sign(name, expires)))
+}
+
+// sign generates the signature for the name and expiration.
+func (s *Signer) sign(name string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s|%d", name, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,97 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	// ErrStalled is returned when a transfer is aborted because it stopped
+	// making progress.
+	ErrStalled = errors.New("transfer stalled")
+
+	// ErrCancelled is returned when a transfer is aborted because it was
+	// cancelled by an operator.
+	ErrCancelled = errors.New("transfer cancelled")
+)
+
+// Watch returns a context which is cancelled with ErrStalled if the progress
+// stops advancing for longer than idle. Once all of the bytes have been
+// transferred, it allows up to finish for the other side to complete, such as
+// flushing the plot to disk. The context is also cancelled if the transfer is
+// cancelled through its tracker. The returned function must be called to stop
+// watching.
+func Watch(p *Progress, idle, finish time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(p.ctx)
+
+	go func() {
+		ticker := time.NewTicker(min(idle, finish) / 4)
+		defer ticker.Stop()
+
+		last := p.bytes.Load()
+		lastChange := time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-ticker.C:
+				bytes := p.bytes.Load()
+				if bytes != last {
+					last = bytes
+					lastChange = time.Now()
+					continue
+				}
+
+				timeout := idle
+				if bytes >= p.size {
+					timeout = finish
+				}
+				if time.Since(lastChange) > timeout {
+					cancel(fmt.Errorf("%w: no progress in %s", ErrStalled, timeout.String()))
+					return
+				}
+			}
+		}
+	}()
+
+	return ctx, func() { cancel(context.Canceled) }
+}
+
+// Cause returns the stall or cancellation error if the context was cancelled
+// due to the transfer stalling or being cancelled, and otherwise returns err
+// unchanged.
+func Cause(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if cause := context.Cause(ctx); errors.Is(cause, ErrStalled) || errors.Is(cause, ErrCancelled) {
+		return cause
+	}
+	return err
+}
+
+// CauseReader wraps a reader whose reads are cancelled by a context from
+// Watch, so that errors due to the transfer stalling or being cancelled are
+// returned as that error.
+func CauseReader(ctx context.Context, r io.Reader) io.Reader {
+	return &causeReader{ctx: ctx, r: r}
+}
+
+type causeReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *causeReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = Cause(c.ctx, err)
+	}
+	return n, err
+}
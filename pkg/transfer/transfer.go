@@ -0,0 +1,116 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package transfer
+
+import (
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+const (
+	// HeaderCommitRanges is sent by the plotter once all ranges of a
+	// multi-stream upload have been sent. It lists each range along with its
+	// checksum so the harvester can verify what it received before committing.
+	HeaderCommitRanges = "X-Garden-Commit-Ranges"
+
+	// HeaderPullResult is sent by the harvester back to the plotter's source
+	// URL once it has finished pulling a plot. It contains the status code the
+	// harvester would have responded with had the plot been pushed to it.
+	HeaderPullResult = "X-Garden-Pull-Result"
+)
+
+// Castagnoli is the CRC32 table used for range checksums.
+var Castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Range is a byte range of a plot file. End is inclusive, matching the
+// Content-Range header.
+type Range struct {
+	Start    int64
+	End      int64
+	Checksum uint32
+}
+
+// Len returns the number of bytes in the range.
+func (r Range) Len() int64 {
+	return r.End - r.Start + 1
+}
+
+// SplitRanges will divide a file of the specified size into n contiguous
+// ranges of roughly equal size.
+func SplitRanges(size int64, n int) []Range {
+	if n < 1 {
+		n = 1
+	}
+	chunk := (size + int64(n) - 1) / int64(n)
+
+	ranges := make([]Range, 0, n)
+	for start := int64(0); start < size; start += chunk {
+		end := min(start+chunk, size) - 1
+		ranges = append(ranges, Range{Start: start, End: end})
+	}
+	return ranges
+}
+
+// FormatContentRange returns the Content-Range header value for the range.
+func FormatContentRange(r Range, size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.End, size)
+}
+
+// ParseContentRange parses a Content-Range header value, returning the range
+// and the total size of the file.
+func ParseContentRange(s string) (Range, int64, error) {
+	var r Range
+	var size int64
+	_, err := fmt.Sscanf(s, "bytes %d-%d/%d", &r.Start, &r.End, &size)
+	if err != nil {
+		return r, 0, fmt.Errorf("invalid content range %q: %v", s, err)
+	}
+	if r.Start < 0 || r.End < r.Start || r.End >= size {
+		return r, 0, fmt.Errorf("invalid content range %q", s)
+	}
+	return r, size, nil
+}
+
+// FormatRanges encodes a list of ranges and their checksums for the
+// HeaderCommitRanges header.
+func FormatRanges(ranges []Range) string {
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		parts[i] = fmt.Sprintf("%d-%d:%08x", r.Start, r.End, r.Checksum)
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseRanges decodes a HeaderCommitRanges header value.
+func ParseRanges(s string) ([]Range, error) {
+	parts := strings.Split(s, ",")
+	ranges := make([]Range, 0, len(parts))
+	for _, part := range parts {
+		span, sum, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid range %q", part)
+		}
+		startStr, endStr, ok := strings.Cut(span, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid range %q", part)
+		}
+
+		start, err := strconv.ParseInt(startStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q: %v", part, err)
+		}
+		end, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q: %v", part, err)
+		}
+		checksum, err := strconv.ParseUint(sum, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q: %v", part, err)
+		}
+
+		ranges = append(ranges, Range{Start: start, End: end, Checksum: uint32(checksum)})
+	}
+	return ranges, nil
+}
@@ -2,15 +2,31 @@
 
 package types
 
+import (
+	"slices"
+	"time"
+)
+
 type PlotRequest struct {
-	Name string `json:"name"`
-	Size uint64 `json:"size"`
+	Name      string   `json:"name"`
+	Size      uint64   `json:"size"`
+	SourceUrl string   `json:"source_url,omitempty"`
+	Exclude   []string `json:"exclude,omitempty"`
+
+	// Attributes describe the plot, such as its k-size and compression, and
+	// are matched against the harvester's affinity rules.
+	Attributes map[string]string `json:"attributes,omitempty"`
 }
 
 type PlotResponse struct {
-	Hostname string `json:"hostname"`
-	Store    string `json:"store"`
-	Url      string `json:"url"`
+	Hostname  string `json:"hostname"`
+	MachineId string `json:"machine_id,omitempty"`
+	Store     string `json:"store"`
+	Url       string `json:"url"`
+
+	// Protocol is the protocol of the harvester which responded, taken from
+	// the message headers.
+	Protocol *Protocol `json:"-"`
 }
 
 type PlotLocateRequest struct {
@@ -21,3 +37,201 @@ type PlotLocateRequest struct {
 type PlotLocateResponse struct {
 	Hostname string `json:"hostname"`
 }
+
+// PlotLocateBatchRequest asks the harvesters which of many plots they have, so
+// a plotter with a backlog doesn't need to wait on a request for each.
+type PlotLocateBatchRequest struct {
+	Plots []*PlotLocateRequest `json:"plots"`
+}
+
+// PlotLocateBatchResponse lists the plots from a batch the harvester has, and
+// those it has with a different size.
+type PlotLocateBatchResponse struct {
+	Hostname   string   `json:"hostname"`
+	Found      []string `json:"found"`
+	Mismatched []string `json:"mismatched,omitempty"`
+}
+
+type PlotPullRequest struct {
+	Name      string `json:"name"`
+	Size      uint64 `json:"size"`
+	Store     string `json:"store"`
+	SourceUrl string `json:"source_url"`
+}
+
+type PlotPullResponse struct {
+	Hostname string `json:"hostname"`
+}
+
+type PlotMoveRequest struct {
+	Name      string `json:"name"`
+	Size      uint64 `json:"size"`
+	Store     string `json:"store"`
+	Source    string `json:"source"`
+	MachineId string `json:"machine_id,omitempty"`
+}
+
+type PlotMoveResponse struct {
+	Status int `json:"status"`
+}
+
+type PlotStreamRequest struct {
+	Name  string `json:"name"`
+	Size  uint64 `json:"size"`
+	Store string `json:"store"`
+}
+
+type PlotStreamResponse struct {
+	Hostname string `json:"hostname"`
+	Subject  string `json:"subject"`
+	Offset   uint64 `json:"offset"`
+}
+
+type PlotStreamChunk struct {
+	Name   string
+	Store  string
+	Offset uint64
+	Data   []byte
+}
+
+type PlotStreamAck struct {
+	Offset uint64 `json:"offset"`
+}
+
+type PlotStreamCommit struct {
+	Name     string `json:"name"`
+	Store    string `json:"store"`
+	Checksum string `json:"checksum"`
+}
+
+type PlotStreamResult struct {
+	Status int `json:"status"`
+}
+
+type TransferProgress struct {
+	Name     string    `json:"name"`
+	Hostname string    `json:"hostname"`
+	Role     string    `json:"role"`
+	Peer     string    `json:"peer"`
+	Size     uint64    `json:"size"`
+	Bytes    uint64    `json:"bytes"`
+	Rate     uint64    `json:"rate"`
+	Eta      float64   `json:"eta"`
+	Started  time.Time `json:"started"`
+	Finished bool      `json:"finished"`
+}
+
+type TransferCancelRequest struct {
+	Name string `json:"name"`
+	Park bool   `json:"park"`
+}
+
+type TransferCancelResponse struct {
+	Hostname  string `json:"hostname"`
+	Role      string `json:"role"`
+	Cancelled int    `json:"cancelled"`
+}
+
+type HarvesterStatus struct {
+	Hostname  string              `json:"hostname"`
+	Url       string              `json:"url"`
+	Labels    map[string]string   `json:"labels,omitempty"`
+	Transfers []*TransferProgress `json:"transfers"`
+	Paths     []*PathStatus       `json:"paths"`
+	Declined  map[string]int64    `json:"declined,omitempty"`
+}
+
+// Heartbeat is published periodically by each harvester, so plotters and
+// operators know which harvesters are online and how much room they have.
+type Heartbeat struct {
+	Hostname     string        `json:"hostname"`
+	Url          string        `json:"url"`
+	Interval     time.Duration `json:"interval"`
+	Transfers    int64         `json:"transfers"`
+	MaxTransfers int64         `json:"max_transfers"`
+	Draining     bool          `json:"draining"`
+	Paths        int           `json:"paths"`
+	BusyPaths    int           `json:"busy_paths"`
+	Plots        int           `json:"plots"`
+	FreeSpace    uint64        `json:"free_space"`
+	TotalSpace   uint64        `json:"total_space"`
+
+	// Protocol is the protocol of the harvester, from the message headers.
+	Protocol *Protocol `json:"-"`
+}
+
+type PathStatus struct {
+	Path       string            `json:"path"`
+	FreeSpace  uint64            `json:"free_space"`
+	TotalSpace uint64            `json:"total_space"`
+	Reserved   uint64            `json:"reserved"`
+	Plots      int               `json:"plots"`
+	MaxPlots   int               `json:"max_plots,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Busy       bool              `json:"busy"`
+	Paused     bool              `json:"paused"`
+}
+
+// Reasons a harvester may decline to store a plot.
+const (
+	ReasonInvalidRequest = "invalid_request"
+	ReasonInvalidToken   = "invalid_token"
+	ReasonUnknownPath    = "unknown_path"
+	ReasonMaxTransfers   = "max_transfers"
+	ReasonBusy           = "busy"
+	ReasonNoSpace        = "no_space"
+	ReasonExists         = "exists"
+	ReasonConflict       = "conflict"
+	ReasonStorageFailure = "storage_failure"
+	ReasonForeignPlot    = "foreign_plot"
+	ReasonNoMatch        = "no_matching_path"
+	ReasonSizeMismatch   = "size_mismatch"
+	ReasonDraining       = "draining"
+)
+
+type TransferError struct {
+	Status  int    `json:"status"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (e *TransferError) Error() string {
+	return e.Message
+}
+
+// ProtocolVersion is the version of the protocol spoken between plotters and
+// harvesters. It is incremented whenever a change is made which older hosts
+// can't handle, and is exchanged along with the capabilities in the headers of
+// every message.
+const ProtocolVersion = 2
+
+// Capabilities which plotters and harvesters may support. Features are only
+// used when both sides of a transfer support them.
+const (
+	CapRanged      = "ranged"
+	CapStream      = "stream"
+	CapPull        = "pull"
+	CapMove        = "move"
+	CapCancel      = "cancel"
+	CapExclude     = "exclude"
+	CapAttributes  = "attributes"
+	CapDecline     = "decline"
+	CapLocateBatch = "locate_batch"
+)
+
+// Capabilities are all of the capabilities supported by this version.
+var Capabilities = []string{CapRanged, CapStream, CapPull, CapMove, CapCancel, CapExclude, CapAttributes, CapDecline, CapLocateBatch}
+
+// Protocol is the protocol version and capabilities of the host which sent a
+// message. Hosts from before versioning was added are version 1 and have no
+// capabilities.
+type Protocol struct {
+	Hostname     string
+	Version      int
+	Capabilities []string
+}
+
+// Has returns whether the host supports the capability.
+func (p *Protocol) Has(capability string) bool {
+	return p != nil && slices.Contains(p.Capabilities, capability)
+}
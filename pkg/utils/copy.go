@@ -0,0 +1,48 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+//go:build linux
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// copyChunkSize is how much data is copied by each copy_file_range call,
+	// so progress can be reported and cancellation checked in between.
+	copyChunkSize = 64 << 20
+)
+
+// CopyFile copies size bytes from the start of src to dst with copy_file_range,
+// so the data doesn't go through userspace. Kernels and filesystems which
+// can't copy between the files fall back to a regular copy. The progress
+// function is called with the number of bytes copied after each chunk, and
+// the copy stops once the context is done.
+func CopyFile(ctx context.Context, dst, src *os.File, size int64, progress func(int64)) error {
+	var copied int64
+	for copied < size {
+		if err := ctx.Err(); err != nil {
+			return context.Cause(ctx)
+		}
+
+		n, err := unix.CopyFileRange(int(src.Fd()), nil, int(dst.Fd()), nil, int(min(copyChunkSize, size-copied)), 0)
+		if err != nil {
+			if copied == 0 && (unsupported(err) || errors.Is(err, unix.EXDEV)) {
+				return copyFallback(ctx, dst, src, size, progress)
+			}
+			return err
+		}
+		if n == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		copied += int64(n)
+		progress(int64(n))
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+//go:build !linux
+
+package utils
+
+import (
+	"context"
+	"os"
+)
+
+// CopyFile copies size bytes from the start of src to dst on platforms without
+// copy_file_range.
+func CopyFile(ctx context.Context, dst, src *os.File, size int64, progress func(int64)) error {
+	return copyFallback(ctx, dst, src, size, progress)
+}
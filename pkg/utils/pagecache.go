@@ -0,0 +1,224 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+//go:build linux
+
+package utils
+
+import (
+	"errors"
+	"io"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// dropChunkSize is how much data is processed before advising the kernel
+	// to drop the pages from the page cache.
+	dropChunkSize = 64 << 20
+
+	// directAlignment is the buffer and offset alignment required for O_DIRECT
+	// writes. 4KiB covers both 512e and 4Kn disks.
+	directAlignment = 4096
+
+	// directBufferSize is the size of the aligned buffer used for O_DIRECT.
+	directBufferSize = 8 << 20
+)
+
+// DropBehindReader reads a section of a file sequentially and will advise the
+// kernel to drop pages from the page cache once they've been read. This keeps
+// large transfers from evicting more useful data. Multiple readers can be used
+// concurrently on different sections of the same file.
+type DropBehindReader struct {
+	f       *os.File
+	offset  int64
+	end     int64
+	dropped int64
+}
+
+// NewDropBehindReader returns a new DropBehindReader for length bytes of the
+// file starting at offset, and advises the kernel that it will be read
+// sequentially.
+func NewDropBehindReader(f *os.File, offset, length int64) *DropBehindReader {
+	unix.Fadvise(int(f.Fd()), offset, length, unix.FADV_SEQUENTIAL)
+	return &DropBehindReader{f: f, offset: offset, end: offset + length, dropped: offset}
+}
+
+// Read reads from the underlying file, dropping pages which have already been
+// consumed.
+func (r *DropBehindReader) Read(p []byte) (int, error) {
+	if r.offset >= r.end {
+		return 0, io.EOF
+	}
+	if remaining := r.end - r.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := r.f.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if r.offset-r.dropped >= dropChunkSize {
+		unix.Fadvise(int(r.f.Fd()), r.dropped, r.offset-r.dropped, unix.FADV_DONTNEED)
+		r.dropped = r.offset
+	}
+	return n, err
+}
+
+// Close drops any remaining pages which have been read. It does not close the
+// underlying file.
+func (r *DropBehindReader) Close() error {
+	unix.Fadvise(int(r.f.Fd()), r.dropped, r.offset-r.dropped, unix.FADV_DONTNEED)
+	r.dropped = r.offset
+	return nil
+}
+
+// DropBehindWriter wraps a file being written sequentially and progressively
+// flushes and drops written pages from the page cache. Writeback for each chunk
+// is started as soon as it is written, and the prior chunk is waited on and
+// then dropped, so the amount of dirty data stays bounded.
+type DropBehindWriter struct {
+	f       *os.File
+	start   int64
+	offset  int64
+	flushed int64
+	dropped int64
+}
+
+// NewDropBehindWriter returns a new DropBehindWriter for the file.
+func NewDropBehindWriter(f *os.File) *DropBehindWriter {
+	return NewDropBehindWriterAt(f, 0)
+}
+
+// NewDropBehindWriterAt returns a new DropBehindWriter which writes to the file
+// starting at offset, rather than at the file's current position. Multiple
+// writers can be used concurrently on different sections of the same file.
+func NewDropBehindWriterAt(f *os.File, offset int64) *DropBehindWriter {
+	return &DropBehindWriter{f: f, start: offset, offset: offset, flushed: offset, dropped: offset}
+}
+
+// Write writes to the underlying file, managing writeback of prior chunks.
+func (w *DropBehindWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	if w.offset-w.flushed >= dropChunkSize {
+		fd := int(w.f.Fd())
+
+		// start writeback on the newly written chunk
+		unix.SyncFileRange(fd, w.flushed, w.offset-w.flushed, unix.SYNC_FILE_RANGE_WRITE)
+
+		// wait for the previous chunk to be on disk and drop it
+		if w.flushed > w.dropped {
+			unix.SyncFileRange(fd, w.dropped, w.flushed-w.dropped,
+				unix.SYNC_FILE_RANGE_WAIT_BEFORE|unix.SYNC_FILE_RANGE_WRITE|unix.SYNC_FILE_RANGE_WAIT_AFTER)
+			unix.Fadvise(fd, w.dropped, w.flushed-w.dropped, unix.FADV_DONTNEED)
+			w.dropped = w.flushed
+		}
+		w.flushed = w.offset
+	}
+	return n, err
+}
+
+// Flush waits for the writeback of the remaining chunks and drops their pages.
+// It does not fsync the file, which is left to the caller when committing it.
+func (w *DropBehindWriter) Flush() error {
+	fd := int(w.f.Fd())
+	if w.offset > w.dropped {
+		err := unix.SyncFileRange(fd, w.dropped, w.offset-w.dropped,
+			unix.SYNC_FILE_RANGE_WAIT_BEFORE|unix.SYNC_FILE_RANGE_WRITE|unix.SYNC_FILE_RANGE_WAIT_AFTER)
+		if err != nil && !unsupported(err) {
+			return err
+		}
+	}
+	unix.Fadvise(fd, w.start, w.offset-w.start, unix.FADV_DONTNEED)
+	w.dropped = w.offset
+	w.flushed = w.offset
+	return nil
+}
+
+// OpenDirect creates the file for writing with O_DIRECT, bypassing the page
+// cache entirely. Not all filesystems support O_DIRECT, so callers should be
+// prepared to fall back on an error.
+func OpenDirect(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC|unix.O_DIRECT, 0644)
+}
+
+// DirectWriter buffers writes into an aligned buffer so they can be written to
+// a file opened with O_DIRECT. Flush must be called when done to write out the
+// final unaligned tail.
+type DirectWriter struct {
+	f   *os.File
+	buf []byte
+	n   int
+}
+
+// NewDirectWriter returns a new DirectWriter for the file, which should have
+// been opened with OpenDirect.
+func NewDirectWriter(f *os.File) *DirectWriter {
+	return &DirectWriter{f: f, buf: alignedBuffer(directBufferSize)}
+}
+
+// Write copies the data into the aligned buffer, writing it out to the file as
+// it fills.
+func (w *DirectWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		c := copy(w.buf[w.n:], p)
+		w.n += c
+		written += c
+		p = p[c:]
+
+		if w.n == len(w.buf) {
+			if _, err := w.f.Write(w.buf); err != nil {
+				return written, err
+			}
+			w.n = 0
+		}
+	}
+	return written, nil
+}
+
+// Flush writes out any remaining buffered data. The aligned portion is written
+// directly, and O_DIRECT is then cleared on the file to write the unaligned
+// tail.
+func (w *DirectWriter) Flush() error {
+	aligned := w.n - w.n%directAlignment
+	if aligned > 0 {
+		if _, err := w.f.Write(w.buf[:aligned]); err != nil {
+			return err
+		}
+	}
+
+	if tail := w.buf[aligned:w.n]; len(tail) > 0 {
+		fd := int(w.f.Fd())
+		flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0)
+		if err != nil {
+			return err
+		}
+		if _, err := unix.FcntlInt(uintptr(fd), unix.F_SETFL, flags&^unix.O_DIRECT); err != nil {
+			return err
+		}
+		if _, err := w.f.Write(tail); err != nil {
+			return err
+		}
+	}
+
+	w.n = 0
+	return nil
+}
+
+// alignedBuffer allocates a byte slice of the given size whose start address
+// is aligned for O_DIRECT.
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directAlignment)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & (directAlignment - 1)); rem != 0 {
+		offset = directAlignment - rem
+	}
+	return buf[offset : offset+size]
+}
+
+// unsupported returns whether the error is from the filesystem not supporting
+// the operation, such as on NFS or FUSE mounts.
+func unsupported(err error) bool {
+	return errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EINVAL)
+}
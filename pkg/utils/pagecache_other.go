@@ -0,0 +1,67 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+//go:build !linux
+
+package utils
+
+import (
+	"io"
+	"os"
+)
+
+// DropBehindReader is a passthrough on platforms without fadvise.
+type DropBehindReader struct {
+	*io.SectionReader
+}
+
+// NewDropBehindReader returns a new passthrough DropBehindReader for length
+// bytes of the file starting at offset.
+func NewDropBehindReader(f *os.File, offset, length int64) *DropBehindReader {
+	return &DropBehindReader{io.NewSectionReader(f, offset, length)}
+}
+
+// Close is a no-op.
+func (r *DropBehindReader) Close() error {
+	return nil
+}
+
+// DropBehindWriter is a passthrough on platforms without sync_file_range.
+type DropBehindWriter struct {
+	io.Writer
+}
+
+// NewDropBehindWriter returns a new passthrough DropBehindWriter.
+func NewDropBehindWriter(f *os.File) *DropBehindWriter {
+	return &DropBehindWriter{f}
+}
+
+// NewDropBehindWriterAt returns a new passthrough DropBehindWriter which writes
+// to the file starting at offset.
+func NewDropBehindWriterAt(f *os.File, offset int64) *DropBehindWriter {
+	return &DropBehindWriter{io.NewOffsetWriter(f, offset)}
+}
+
+// Flush is a no-op.
+func (w *DropBehindWriter) Flush() error {
+	return nil
+}
+
+// OpenDirect simply creates the file on platforms without O_DIRECT.
+func OpenDirect(name string) (*os.File, error) {
+	return os.Create(name)
+}
+
+// DirectWriter is a passthrough on platforms without O_DIRECT.
+type DirectWriter struct {
+	*os.File
+}
+
+// NewDirectWriter returns a new passthrough DirectWriter.
+func NewDirectWriter(f *os.File) *DirectWriter {
+	return &DirectWriter{f}
+}
+
+// Flush is a no-op.
+func (w *DirectWriter) Flush() error {
+	return nil
+}
@@ -0,0 +1,22 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+//go:build linux
+
+package utils
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Preallocate reserves size bytes of disk space for the file, so it can be
+// written out of order without fragmenting. Filesystems which don't support
+// fallocate, such as NFS, have the file extended to size instead.
+func Preallocate(f *os.File, size int64) error {
+	err := unix.Fallocate(int(f.Fd()), 0, 0, size)
+	if err != nil && unsupported(err) {
+		return f.Truncate(size)
+	}
+	return err
+}
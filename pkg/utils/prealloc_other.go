@@ -0,0 +1,14 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+//go:build !linux
+
+package utils
+
+import (
+	"os"
+)
+
+// Preallocate extends the file to size bytes on platforms without fallocate.
+func Preallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
@@ -3,7 +3,10 @@
 package utils
 
 import (
+	"context"
+	"io"
 	"net"
+	"os"
 	"strings"
 )
 
@@ -21,6 +24,22 @@ func GetHostIP() net.IP {
 	return conn.LocalAddr().(*net.UDPAddr).IP
 }
 
+// GetMachineID returns the unique ID of the machine from the systemd/dbus
+// machine-id file. It returns an empty string if it is not available, such as
+// within most containers.
+func GetMachineID() string {
+	for _, path := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
 // ArrayFlags can be used with flags.Var to specify the a command line argument
 // multiple timmes.
 type ArrayFlags []string
@@ -35,3 +54,22 @@ func (i *ArrayFlags) Set(value string) error {
 	*i = append(*i, value)
 	return nil
 }
+
+// copyFallback copies size bytes from src to dst through userspace, in chunks
+// so progress can be reported and cancellation checked in between.
+func copyFallback(ctx context.Context, dst, src *os.File, size int64, progress func(int64)) error {
+	var copied int64
+	for copied < size {
+		if err := ctx.Err(); err != nil {
+			return context.Cause(ctx)
+		}
+
+		n, err := io.CopyN(dst, src, min(8<<20, size-copied))
+		copied += n
+		progress(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}